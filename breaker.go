@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// 节点的可达状态
+const (
+	nodeReachable   = "REACHABLE"
+	nodeSuspect     = "SUSPECT"     // 有失败，但还未达到阈值
+	nodeUnreachable = "UNREACHABLE" // 连续失败达到阈值
+)
+
+// breakerConfig 节点熔断配置
+type breakerConfig struct {
+	Threshold  int      `json:"threshold"`   // 连续失败多少次后认为节点不可达
+	Backoff    duration `json:"backoff"`     // 第一次失败后跳过该节点的时间，之后每次失败翻倍
+	MaxBackoff duration `json:"max_backoff"` // 退避时间上限
+}
+
+// breaker
+// 节点熔断器，一个不回复的节点按指数退避跳过轮询，避免拖慢集中器下的其他节点
+type breaker struct {
+	cfg      breakerConfig
+	status   string
+	failures int       // 连续失败次数
+	until    time.Time // 在此之前跳过该节点
+}
+
+func newBreaker(cfg breakerConfig) *breaker {
+	return &breaker{
+		cfg:    cfg,
+		status: nodeReachable,
+	}
+}
+
+// allow 是否可以轮询该节点
+func (b *breaker) allow(now time.Time) bool {
+	return !now.Before(b.until)
+}
+
+// success 记录一次成功，返回状态是否由不可达变为可达
+func (b *breaker) success() bool {
+	recovered := b.status == nodeUnreachable
+
+	b.status = nodeReachable
+	b.failures = 0
+	b.until = time.Time{}
+
+	return recovered
+}
+
+// failure 记录一次失败，返回状态是否变为不可达
+func (b *breaker) failure(now time.Time) bool {
+	b.failures++
+
+	backoff := time.Duration(b.cfg.Backoff)
+	for i := 1; i < b.failures && backoff < time.Duration(b.cfg.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(b.cfg.MaxBackoff) {
+		backoff = time.Duration(b.cfg.MaxBackoff)
+	}
+
+	b.until = now.Add(backoff)
+
+	if b.failures < b.cfg.Threshold {
+		b.status = nodeSuspect
+		return false
+	}
+
+	unreachable := b.status != nodeUnreachable
+	b.status = nodeUnreachable
+	return unreachable
+}
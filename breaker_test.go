@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"ricn-smart/jg-gw/modbus"
+	"time"
+)
+
+type BreakerTestSuite struct{}
+
+var _ = Suite(&BreakerTestSuite{})
+
+func (s *BreakerTestSuite) TestBackoff(c *C) {
+	b := newBreaker(breakerConfig{
+		Threshold:  3,
+		Backoff:    duration(10 * time.Second),
+		MaxBackoff: duration(30 * time.Second),
+	})
+
+	now := time.Now()
+	c.Assert(b.allow(now), Equals, true)
+
+	c.Assert(b.failure(now), Equals, false)
+	c.Assert(b.status, Equals, nodeSuspect)
+	c.Assert(b.allow(now.Add(9*time.Second)), Equals, false)
+	c.Assert(b.allow(now.Add(10*time.Second)), Equals, true)
+
+	c.Assert(b.failure(now), Equals, false)
+	c.Assert(b.until, Equals, now.Add(20*time.Second))
+
+	// 达到阈值只通知一次
+	c.Assert(b.failure(now), Equals, true)
+	c.Assert(b.status, Equals, nodeUnreachable)
+	c.Assert(b.until, Equals, now.Add(30*time.Second))
+
+	c.Assert(b.failure(now), Equals, false)
+	c.Assert(b.until, Equals, now.Add(30*time.Second))
+
+	c.Assert(b.success(), Equals, true)
+	c.Assert(b.status, Equals, nodeReachable)
+	c.Assert(b.allow(now), Equals, true)
+
+	// 可疑状态恢复不需要通知
+	b.failure(now)
+	c.Assert(b.success(), Equals, false)
+}
+
+func (s *BreakerTestSuite) TestPoweredDown(c *C) {
+	id, err := modbus.NewID(childDeviceNo)
+	c.Assert(err, IsNil)
+
+	gateway := &session{cfg: defaultConfig().Default}
+	gateway.setNodes([]modbus.ID{id})
+	gateway.poweredDown.Store(true)
+
+	// 掉电期间不发出请求，也不记录失败
+	p := newScheduler(gateway, sn, gateway.cfg)
+	p.poll(context.Background(), pollTelemetering)
+	c.Assert(p.breakers, HasLen, 0)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// config
+// 配置文件，路径由环境变量CONFIG_FILE指定，默认为config.json，文件不存在时全部使用默认值
+//
+//	{
+//	  "default": {
+//	    "heartbeat_timeout": "3m",
+//	    "poll": {"telemetering": "30s", "settings": "1h"},
+//	    "report": {"integrity": "10m", "deadbands": {"Ua": {"absolute": 2}, "Ia": {"percent": 5}}}
+//	  },
+//	  "gateways": {
+//	    "182112180128": {"heartbeat_timeout": "5m", "poll": {"nodes": {"072107630289": false}}}
+//	  }
+//	}
+type config struct {
+	Default  gatewayConfig              `json:"default"`
+	Gateways map[string]json.RawMessage `json:"gateways"` // 按集中器sn覆盖默认配置，只需写出不同的字段
+}
+
+// gatewayConfig 单个集中器的配置
+type gatewayConfig struct {
+	HeartbeatTimeout duration      `json:"heartbeat_timeout"` // 超过该时间未收到心跳则认为集中器离线
+	Poll             pollConfig    `json:"poll"`
+	Breaker          breakerConfig `json:"breaker"`
+	Report           reportConfig  `json:"report"`
+}
+
+// pollConfig 轮询配置，间隔为0表示不轮询该类数据
+type pollConfig struct {
+	Telemetering   duration        `json:"telemetering"`   // 遥信（开关状态）
+	Teleindication duration        `json:"teleindication"` // 遥测（电压、电流等模拟量）
+	Settings       duration        `json:"settings"`       // 定值
+	Jitter         duration        `json:"jitter"`         // 每次轮询随机增加0~jitter的延时，避免大量集中器同时轮询
+	Timeout        duration        `json:"timeout"`        // 单个请求等待回复的超时时间，请求期间命令需要等待，应尽量短
+	Nodes          map[string]bool `json:"nodes"`          // 按节点地址启用或禁用轮询，未列出的节点默认启用
+}
+
+var conf = defaultConfig()
+
+func defaultConfig() *config {
+	return &config{
+		Default: gatewayConfig{
+			HeartbeatTimeout: duration(3 * time.Minute),
+			Poll: pollConfig{
+				Telemetering:   duration(60 * time.Second),
+				Teleindication: duration(60 * time.Second),
+				Jitter:         duration(5 * time.Second),
+				Timeout:        duration(3 * time.Second),
+			},
+			Breaker: breakerConfig{
+				Threshold:  3,
+				Backoff:    duration(30 * time.Second),
+				MaxBackoff: duration(10 * time.Minute),
+			},
+			Report: reportConfig{
+				Integrity: duration(15 * time.Minute),
+			},
+		},
+	}
+}
+
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig()
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("配置文件 %v 格式错误：%w", path, err)
+	}
+
+	if err := c.Default.check(); err != nil {
+		return nil, fmt.Errorf("默认配置错误：%w", err)
+	}
+
+	// 提前检查每个集中器的配置，避免运行时才发现错误
+	for sn, raw := range c.Gateways {
+		g, err := c.overlay(raw)
+		if err != nil {
+			return nil, fmt.Errorf("集中器 %v 的配置格式错误：%w", sn, err)
+		}
+		if err := g.check(); err != nil {
+			return nil, fmt.Errorf("集中器 %v 的配置错误：%w", sn, err)
+		}
+	}
+
+	return c, nil
+}
+
+// check 检查取值，心跳超时不大于0时集中器连接后立即被断开，轮询超时不大于0时每个请求立即失败，
+// 退避上限不大于0时不回复的节点从不被跳过
+func (g gatewayConfig) check() error {
+	if g.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("heartbeat_timeout 必须大于0：%v", time.Duration(g.HeartbeatTimeout))
+	}
+	if g.Poll.Timeout <= 0 {
+		return fmt.Errorf("poll.timeout 必须大于0：%v", time.Duration(g.Poll.Timeout))
+	}
+	if g.Breaker.MaxBackoff <= 0 {
+		return fmt.Errorf("breaker.max_backoff 必须大于0：%v", time.Duration(g.Breaker.MaxBackoff))
+	}
+	return nil
+}
+
+// gateway 返回集中器的配置，未单独配置的字段使用默认值
+func (c *config) gateway(sn string) gatewayConfig {
+	raw, ok := c.Gateways[sn]
+	if !ok {
+		raw = []byte("{}")
+	}
+
+	// loadConfig已检查过格式
+	g, _ := c.overlay(raw)
+	return g
+}
+
+// overlay 在默认配置的副本上覆盖raw中的字段，map类型的字段会合并
+func (c *config) overlay(raw json.RawMessage) (gatewayConfig, error) {
+	var g gatewayConfig
+
+	// 通过序列化复制默认配置，避免修改默认配置中的map
+	buf, err := json.Marshal(c.Default)
+	if err != nil {
+		return g, err
+	}
+
+	if err := json.Unmarshal(buf, &g); err != nil {
+		return g, err
+	}
+
+	err = json.Unmarshal(raw, &g)
+	return g, err
+}
+
+// duration 配置文件中以 "90s"、"5m" 的形式书写
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+// enabled 节点是否需要轮询
+func (p pollConfig) enabled(id string) bool {
+	enabled, ok := p.Nodes[id]
+	return !ok || enabled
+}
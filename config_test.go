@@ -0,0 +1,82 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type ConfigTestSuite struct{}
+
+var _ = Suite(&ConfigTestSuite{})
+
+func (s *ConfigTestSuite) TestGateway(c *C) {
+	path := filepath.Join(c.MkDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"default": {"heartbeat_timeout": "2m", "poll": {"nodes": {"072107630289": false}}},
+		"gateways": {"182112180128": {"heartbeat_timeout": "5m", "poll": {"settings": "1h", "nodes": {"072107630290": false}}}}
+	}`), 0644)
+	c.Assert(err, IsNil)
+
+	cfg, err := loadConfig(path)
+	c.Assert(err, IsNil)
+
+	c.Assert(time.Duration(cfg.gateway("182112180128").HeartbeatTimeout), Equals, 5*time.Minute)
+	c.Assert(time.Duration(cfg.gateway("000000000000").HeartbeatTimeout), Equals, 2*time.Minute)
+
+	poll := cfg.gateway("182112180128").Poll
+	c.Assert(time.Duration(poll.Settings), Equals, time.Hour)
+	c.Assert(time.Duration(poll.Telemetering), Equals, time.Minute)
+	c.Assert(poll.enabled("072107630289"), Equals, false)
+	c.Assert(poll.enabled("072107630290"), Equals, false)
+	c.Assert(poll.enabled("072107630291"), Equals, true)
+
+	// 集中器的配置不影响默认配置
+	c.Assert(cfg.gateway("000000000000").Poll.enabled("072107630290"), Equals, true)
+}
+
+func (s *ConfigTestSuite) TestMissing(c *C) {
+	cfg, err := loadConfig(filepath.Join(c.MkDir(), "config.json"))
+	c.Assert(err, IsNil)
+	c.Assert(cfg.gateway(sn), DeepEquals, defaultConfig().Default)
+}
+
+func (s *ConfigTestSuite) TestInvalid(c *C) {
+	path := filepath.Join(c.MkDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"gateways": {"182112180128": {"heartbeat_timeout": "5"}}}`), 0644)
+	c.Assert(err, IsNil)
+
+	_, err = loadConfig(path)
+	c.Assert(err, NotNil)
+}
+
+func (s *ConfigTestSuite) TestHeartbeatTimeout(c *C) {
+	for _, content := range []string{
+		`{"default": {"heartbeat_timeout": "0s"}}`,
+		`{"gateways": {"182112180128": {"heartbeat_timeout": "-1m"}}}`,
+	} {
+		path := filepath.Join(c.MkDir(), "config.json")
+		err := os.WriteFile(path, []byte(content), 0644)
+		c.Assert(err, IsNil)
+
+		_, err = loadConfig(path)
+		c.Assert(err, ErrorMatches, ".*heartbeat_timeout 必须大于0.*")
+	}
+}
+
+func (s *ConfigTestSuite) TestPollTimeout(c *C) {
+	for content, message := range map[string]string{
+		`{"default": {"poll": {"timeout": "0s"}}}`:                            "poll.timeout 必须大于0.*",
+		`{"gateways": {"182112180128": {"poll": {"timeout": "-1s"}}}}`:        "poll.timeout 必须大于0.*",
+		`{"default": {"breaker": {"max_backoff": "0s"}}}`:                     "breaker.max_backoff 必须大于0.*",
+		`{"gateways": {"182112180128": {"breaker": {"max_backoff": "-1m"}}}}`: "breaker.max_backoff 必须大于0.*",
+	} {
+		path := filepath.Join(c.MkDir(), "config.json")
+		err := os.WriteFile(path, []byte(content), 0644)
+		c.Assert(err, IsNil)
+
+		_, err = loadConfig(path)
+		c.Assert(err, ErrorMatches, ".*"+message, Commentf(content))
+	}
+}
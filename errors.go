@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"ricn-smart/jg-gw/modbus"
+)
+
+// 请求失败时返回给云端的错误码，应用根据错误码处理，message仅供人阅读
+const (
+	codeInvalidRequest    = "INVALID_REQUEST"    // 请求格式错误
+	codeUnknownIdentifier = "UNKNOWN_IDENTIFIER" // 找不到标识符对应的寄存器
+	codeInvalidDevice     = "INVALID_DEVICE"     // 节点地址格式错误
+	codeInvalidParam      = "INVALID_PARAM"      // 参数缺失或取值错误
+	codeReadOnly          = "READ_ONLY"          // 只读属性无法写入
+	codeUnsupported       = "UNSUPPORTED"        // 不支持的操作
+	codeDeviceTimeout     = "DEVICE_TIMEOUT"     // 设备未在超时时间内回复
+	codeDeviceOffline     = "DEVICE_OFFLINE"     // 与集中器的连接已断开
+	codeDeviceRejected    = "DEVICE_REJECTED"    // 设备回复执行失败
+	codeInvalidResponse   = "INVALID_RESPONSE"   // 无法解析设备的回复
+	codePartialFailure    = "PARTIAL_FAILURE"    // 多个标识符中部分成功，见results
+	codeMultiple          = "MULTIPLE_ERRORS"    // 多个标识符因不同原因失败，见results
+	codeNotExecuted       = "NOT_EXECUTED"       // 之前的写入失败，未执行
+	codeInternal          = "INTERNAL_ERROR"
+)
+
+// requestError 带错误码的请求错误
+type requestError struct {
+	code string
+	err  error
+}
+
+func newRequestError(code string, err error) error {
+	return &requestError{code: code, err: err}
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// errorCode 返回err对应的错误码，未标记错误码的错误按与设备通信的错误处理
+func errorCode(err error) string {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.code
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return codeDeviceTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, modbus.ErrClosed), errors.Is(err, modbus.ErrServerClosed),
+		errors.Is(err, net.ErrClosed):
+		return codeDeviceOffline
+	default:
+		return codeInternal
+	}
+}
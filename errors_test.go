@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"ricn-smart/jg-gw/modbus"
+)
+
+type ErrorsTestSuite struct{}
+
+var _ = Suite(&ErrorsTestSuite{})
+
+func (s *ErrorsTestSuite) TestErrorCode(c *C) {
+	c.Assert(errorCode(context.DeadlineExceeded), Equals, codeDeviceTimeout)
+	c.Assert(errorCode(fmt.Errorf("write: %w", modbus.ErrClosed)), Equals, codeDeviceOffline)
+	c.Assert(errorCode(newRequestError(codeReadOnly, errors.New(""))), Equals, codeReadOnly)
+	c.Assert(errorCode(errors.New("")), Equals, codeInternal)
+}
+
+func (s *ErrorsTestSuite) TestCommandsError(c *C) {
+	_, _, err := (&getPropertyRequest{ChildDeviceNo: childDeviceNo}).commands()
+	c.Assert(errorCode(err), Equals, codeInvalidRequest)
+
+	_, _, err = (&getPropertyRequest{Identifiers: []string{"OverCurrentTripSetting"}, ChildDeviceNo: "x"}).commands()
+	c.Assert(errorCode(err), Equals, codeInvalidDevice)
+
+	_, results, err := (&getPropertyRequest{Identifiers: []string{"Unknown"}, ChildDeviceNo: childDeviceNo}).commands()
+	c.Assert(err, IsNil)
+	c.Assert(results["Unknown"].Code, Equals, codeUnknownIdentifier)
+
+	resp := summarize("1", results)
+	c.Assert(resp.Success, Equals, false)
+	c.Assert(resp.Code, Equals, codeUnknownIdentifier)
+}
+
+func (s *ErrorsTestSuite) TestSummarize(c *C) {
+	resp := summarize("1", map[string]*result{
+		"OverCurrentTripSetting": {Success: true},
+		"Unknown":                failed(newRequestError(codeUnknownIdentifier, errors.New(""))),
+	})
+	c.Assert(resp.Success, Equals, false)
+	c.Assert(resp.Code, Equals, codePartialFailure)
+
+	resp = summarize("1", map[string]*result{
+		"Switch":  failed(newRequestError(codeInvalidParam, errors.New(""))),
+		"Unknown": failed(newRequestError(codeUnknownIdentifier, errors.New(""))),
+	})
+	c.Assert(resp.Code, Equals, codeMultiple)
+
+	// 未执行的标识符不影响错误码
+	resp = summarize("1", map[string]*result{
+		"OverCurrentTripSetting": failed(newRequestError(codeDeviceRejected, errors.New("遥控失败"))),
+		"Switch":                 failed(newRequestError(codeNotExecuted, errors.New(""))),
+	})
+	c.Assert(resp.Success, Equals, false)
+	c.Assert(resp.Code, Equals, codeDeviceRejected)
+	c.Assert(resp.Message, Equals, "遥控失败")
+
+	resp = summarize("1", map[string]*result{"Switch": {Success: true}})
+	c.Assert(resp.Success, Equals, true)
+	c.Assert(resp.Code, Equals, "")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"reflect"
 	"ricn-smart/jg-gw/modbus"
 	"ricn-smart/jg-gw/mq"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type getHostRequest struct {
@@ -23,31 +26,48 @@ type storage struct {
 
 var snConn storage
 
-func (s *storage) Load(sn string) (*modbus.Conn, bool) {
+func (s *storage) Load(sn string) (*session, bool) {
 	value, ok := s.m.Load(sn)
 	if ok {
-		return value.(*modbus.Conn), true
+		return value.(*session), true
 	}
 	return nil, false
 }
 
-func (s *storage) Store(sn string, conn *modbus.Conn) {
-	s.m.Store(sn, conn)
+func (s *storage) Store(sn string, gateway *session) {
+	s.m.Store(sn, gateway)
+}
+
+// Swap 保存sn对应的会话，返回之前的会话
+func (s *storage) Swap(sn string, gateway *session) (*session, bool) {
+	previous, loaded := s.m.Swap(sn, gateway)
+	if loaded {
+		return previous.(*session), true
+	}
+	return nil, false
 }
 
 func (s *storage) Delete(sn string) {
 	s.m.Delete(sn)
 }
 
-func (s *storage) Range(f func(sn string, conn *modbus.Conn) bool) {
+// CompareAndDelete 只有sn仍然对应gateway时才删除，避免删除同一集中器在新连接上的会话
+func (s *storage) CompareAndDelete(sn string, gateway *session) bool {
+	return s.m.CompareAndDelete(sn, gateway)
+}
+
+func (s *storage) Range(f func(sn string, gateway *session) bool) {
 	s.m.Range(func(key, value any) bool {
-		return f(key.(string), value.(*modbus.Conn))
+		return f(key.(string), value.(*session))
 	})
 }
 
 // handleMQConn
 // mqtt连接上后开始执行订阅
 func handleMQConn(client mqtt.Client) {
+	// 断开期间的变化不会缓存，连接后重新发布实例状态和所属集中器
+	publishStatus(instanceOnline, "")
+	publishSns()
 
 	// 设备host查询
 	if token := client.Subscribe("+/host", mq.AtMostOnce, func(client mqtt.Client, message mqtt.Message) {
@@ -97,9 +117,24 @@ func handleMQConn(client mqtt.Client) {
 type (
 	CommonResponse struct {
 		RequestId string      `json:"request_id"`
-		Success   bool        `json:"success"` // 调用结果是否成功
-		Message   string      `json:"message"` // 消息;
-		Data      interface{} `json:"data"`    // 实际数据
+		Success   bool        `json:"success"`        // 调用结果是否成功
+		Code      string      `json:"code,omitempty"` // 失败时的错误码
+		Message   string      `json:"message"`        // 消息;
+		Data      interface{} `json:"data"`           // 实际数据
+
+		Results map[string]*result `json:"results,omitempty"` // 按标识符的执行结果
+		Units   map[string]string  `json:"units,omitempty"`   // 读取到的属性的单位
+
+		Verified *bool `json:"verified,omitempty"` // verify模式下所有标识符是否都已确认
+	}
+
+	// result 单个标识符的执行结果
+	result struct {
+		Success  bool   `json:"success"`
+		Cached   bool   `json:"cached,omitempty"`   // 从缓存返回，未读取设备
+		Verified *bool  `json:"verified,omitempty"` // verify模式下，写入后读到的值是否一致
+		Code     string `json:"code,omitempty"`
+		Message  string `json:"message,omitempty"`
 	}
 
 	setPropertyRequest struct {
@@ -107,15 +142,52 @@ type (
 		Identifiers   []string       `json:"identifiers"`
 		Params        map[string]any `json:"params"`
 		ChildDeviceNo string         `json:"child_device_no"`
+		Timeout       int64          `json:"timeout"`        // 等待设备回复的超时时间，单位毫秒，每个写入单独计算
+		Verify        bool           `json:"verify"`         // 写入成功后再读取，确认设备上的值与写入的一致
+		VerifyTimeout int64          `json:"verify_timeout"` // 写入成功后确认的超时时间，单位毫秒，开关动作需要时间
 	}
 
 	getPropertyRequest struct {
 		RequestId     string   `json:"request_id"`
 		Identifiers   []string `json:"identifiers"`
 		ChildDeviceNo string   `json:"child_device_no"`
+		Timeout       int64    `json:"timeout"` // 等待设备回复的超时时间，单位毫秒
+		MaxAge        int64    `json:"max_age"` // 大于0时，读取时间在max_age毫秒以内的属性直接从缓存返回
 	}
 )
 
+// 请求未指定超时时间时使用
+const defaultRequestTimeout = 10 * time.Second
+
+func requestTimeout(ms int64) time.Duration {
+	if ms <= 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (g *getPropertyRequest) timeout() time.Duration {
+	return requestTimeout(g.Timeout)
+}
+
+func (s *setPropertyRequest) timeout() time.Duration {
+	return requestTimeout(s.Timeout)
+}
+
+func (s *setPropertyRequest) verifyTimeout() time.Duration {
+	return requestTimeout(s.VerifyTimeout)
+}
+
+// action 只有遥控时为"遥控"，有定值时为"写入"
+func (s *setPropertyRequest) action() string {
+	for _, identifier := range s.Identifiers {
+		if _, ok := modbus.FindRegister(identifier).(*modbus.ControlRegister); !ok {
+			return "写入"
+		}
+	}
+	return "遥控"
+}
+
 func getHost(sn string, client mqtt.Client, payload []byte) {
 	_, ok := snConn.Load(sn)
 	if ok {
@@ -140,35 +212,218 @@ func getHost(sn string, client mqtt.Client, payload []byte) {
 	}
 }
 
-func (g *getPropertyRequest) Frame() (*modbus.Frame, func(frame *modbus.Frame) (map[string]any, error), error) {
-	if len(g.Identifiers) == 0 {
-		return nil, nil, errors.New("标识符不能为空")
+// readCommand 一帧读取的标识符
+type readCommand struct {
+	identifiers []string
+	frame       *modbus.Frame
+	parser      func(frame *modbus.Frame) (map[string]any, error)
+}
+
+// writeCommand 一帧写入的标识符
+type writeCommand struct {
+	identifiers []string
+	frame       *modbus.Frame
+	parser      func(frame *modbus.Frame) (bool, error)
+	verifier    verifier // 为空表示无法确认
+}
+
+// identifiers 去除重复的标识符，保持顺序
+func identifiers(identifiers []string) ([]string, error) {
+	if len(identifiers) == 0 {
+		return nil, newRequestError(codeInvalidRequest, errors.New("标识符不能为空"))
+	}
+
+	var list []string
+	seen := make(map[string]bool)
+	for _, identifier := range identifiers {
+		if !seen[identifier] {
+			seen[identifier] = true
+			list = append(list, identifier)
+		}
+	}
+	return list, nil
+}
+
+// commands
+// 遥信点、遥测量各用一帧读取，定值尽量合并到一帧读取，无法读取的标识符记录在results中，其余标识符照常读取
+func (g *getPropertyRequest) commands() ([]*readCommand, map[string]*result, error) {
+	list, err := identifiers(g.Identifiers)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	id, err := modbus.NewID(g.ChildDeviceNo)
+	if err != nil {
+		return nil, nil, newRequestError(codeInvalidDevice, err)
+	}
+
+	results := make(map[string]*result)
+
+	telemetering := &readCommand{
+		frame: modbus.NewTelemetering(id),
+		parser: func(frame *modbus.Frame) (map[string]any, error) {
+			values := make(map[string]any)
+			return values, frame.NewTelemeteringAck(values)
+		},
+	}
+
+	teleindication := &readCommand{
+		frame: modbus.NewTeleindication(id),
+		parser: func(frame *modbus.Frame) (map[string]any, error) {
+			values := make(map[string]any)
+			return values, frame.NewTeleindicationAck(values)
+		},
+	}
+
+	var registers []*modbus.ActionRegister
+	for _, identifier := range list {
+		// 遥信点Switch与遥控寄存器同名，读取时为开关状态
+		if modbus.IsTelemetering(identifier) {
+			telemetering.identifiers = append(telemetering.identifiers, identifier)
+			continue
+		}
+
+		if modbus.IsTeleindication(identifier) {
+			teleindication.identifiers = append(teleindication.identifiers, identifier)
+			continue
+		}
+
+		register := modbus.FindRegister(identifier)
+		if register == nil {
+			results[identifier] = failed(newRequestError(codeUnknownIdentifier, fmt.Errorf("找不到匹配的寄存器：%v", identifier)))
+			continue
+		}
+
+		ar, ok := register.(*modbus.ActionRegister)
+		if !ok {
+			results[identifier] = failed(newRequestError(codeUnsupported, fmt.Errorf("不支持的寄存器类型，期望：*modbus.ActionRegister，实际：%v", reflect.TypeOf(register))))
+			continue
+		}
+
+		if !ar.Access().CanRead() {
+			results[identifier] = failed(newRequestError(codeUnsupported, fmt.Errorf("只写寄存器无法读取:%v", identifier)))
+			continue
+		}
+
+		registers = append(registers, ar)
+	}
+
+	var commands []*readCommand
+	for _, cmd := range []*readCommand{telemetering, teleindication} {
+		if len(cmd.identifiers) > 0 {
+			commands = append(commands, cmd)
+		}
+	}
+
+	for _, batch := range modbus.Batch(registers) {
+		batch := batch
+		cmd := &readCommand{
+			frame: modbus.NewMultiReadFrame(id, batch),
+			parser: func(frame *modbus.Frame) (map[string]any, error) {
+				return modbus.ParseMultiReadResp(frame, batch)
+			},
+		}
+		for _, r := range batch {
+			cmd.identifiers = append(cmd.identifiers, r.Name())
+		}
+		commands = append(commands, cmd)
+	}
+
+	return commands, results, nil
+}
+
+// do 读取属性，返回读到的值和每个标识符的结果，读到的值同时更新节点状态缓存
+func (g *getPropertyRequest) do(gateway *session) (map[string]any, map[string]*result, error) {
+	commands, results, err := g.commands()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// 默认只支持单个寄存器
-	identifier := g.Identifiers[0]
-	register := modbus.FindRegister(identifier)
-	if register == nil {
-		return nil, nil, fmt.Errorf("找不到匹配的寄存器：%v", identifier)
+	// commands已检查过节点地址
+	id, _ := modbus.NewID(g.ChildDeviceNo)
+	node := id.String()
+
+	data := make(map[string]any)
+
+	if g.MaxAge > 0 {
+		commands = g.fromCache(gateway.sn, node, commands, data, results)
 	}
 
-	ar, ok := register.(*modbus.ActionRegister)
-	if ok {
-		framer := ar.ReadFrame(id)
-		return framer, ar.ParserReadResp, nil
-	} else {
-		return nil, nil, fmt.Errorf("不支持的寄存器类型，期望：*modbus.ActionRegister，实际：%v", reflect.TypeOf(register))
+	ctx, cancel := context.WithTimeout(gateway.conn.Context(), g.timeout())
+	defer cancel()
+
+	for _, cmd := range commands {
+		var values map[string]any
+
+		respFrame, err := gateway.do(ctx, cmd.frame)
+		if err == nil {
+			values, err = cmd.parser(respFrame)
+			if err != nil {
+				err = newRequestError(codeInvalidResponse, err)
+			}
+		}
+
+		if err == nil {
+			updateShadow(gateway.sn, node, values, time.Now(), time.Duration(gateway.cfg.Report.Integrity))
+		}
+
+		for _, identifier := range cmd.identifiers {
+			if err != nil {
+				results[identifier] = failed(err)
+				continue
+			}
+
+			value, ok := values[identifier]
+			if !ok {
+				results[identifier] = failed(newRequestError(codeInvalidResponse, fmt.Errorf("回复中没有 %v", identifier)))
+				continue
+			}
+
+			data[identifier] = value
+			results[identifier] = &result{Success: true}
+		}
+	}
+
+	return data, results, nil
+}
+
+// fromCache 缓存中足够新的属性直接返回，返回仍需读取设备的命令
+func (g *getPropertyRequest) fromCache(sn string, node string, commands []*readCommand, data map[string]any, results map[string]*result) []*readCommand {
+	var remaining []*readCommand
+
+	for _, cmd := range commands {
+		values := cached(sn, node, cmd.identifiers, time.Duration(g.MaxAge)*time.Millisecond, time.Now())
+
+		var missing []string
+		for _, identifier := range cmd.identifiers {
+			value, ok := values[identifier]
+			if !ok {
+				missing = append(missing, identifier)
+				continue
+			}
+
+			data[identifier] = value
+			results[identifier] = &result{Success: true, Cached: true}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		// 同一帧的其他属性仍从设备读取，帧本身不变
+		remaining = append(remaining, &readCommand{
+			identifiers: missing,
+			frame:       cmd.frame,
+			parser:      cmd.parser,
+		})
 	}
+
+	return remaining
 }
 
 func getProperty(sn string, client mqtt.Client, payload []byte) {
 	// 判断sn是否在连接过当前app
-	conn, ok := snConn.Load(sn)
+	gateway, ok := snConn.Load(sn)
 	if !ok {
 		// 设备未在当前应用上线，忽略请求
 		return
@@ -177,104 +432,210 @@ func getProperty(sn string, client mqtt.Client, payload []byte) {
 	var request getPropertyRequest
 
 	if err := json.Unmarshal(payload, &request); err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Str("sn", sn).Msg("getProperty")
+		// 类型错误时其余字段仍会解析，拿到RequestId就回复
+		reply(client, sn, "getProperty", failure(request.RequestId, newRequestError(codeInvalidRequest, err)))
 		return
 	}
 
 	log.Info().Str("sn", sn).Interface("request", request).Msg("getProperty")
 
-	frame, parser, err := request.Frame()
+	data, results, err := request.do(gateway)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Str("sn", sn).Msg("getProperty")
+		reply(client, sn, "getProperty", failure(request.RequestId, err))
 		return
 	}
 
-	conn.Lock()
-	defer conn.Unlock()
-
-	if err := conn.Write(frame, timeout); err != nil {
-		log.Error().Err(err).Msg("")
-		return
+	resp := summarize(request.RequestId, results)
+	resp.Data = data
+	resp.Units = units(data)
+	if resp.Success {
+		resp.Message = "OK"
 	}
 
-	respFrame, err := conn.Read(size, timeout)
+	reply(client, sn, "getProperty", resp)
+}
+
+// commands
+// 定值合并到一帧写入，遥控单独一帧
+// 任何标识符的参数有误时整个请求都不执行，results中记录出错的标识符，避免只写入了一部分定值
+func (s *setPropertyRequest) commands() ([]*writeCommand, map[string]*result, error) {
+	list, err := identifiers(s.Identifiers)
 	if err != nil {
-		log.Error().Err(err).Msg("")
-		return
+		return nil, nil, err
 	}
 
-	data, err := parser(respFrame)
+	id, err := modbus.NewID(s.ChildDeviceNo)
 	if err != nil {
-		log.Error().Err(err).Msg("")
-		return
+		return nil, nil, newRequestError(codeInvalidDevice, err)
 	}
 
-	resp := &CommonResponse{
-		RequestId: request.RequestId,
-		Success:   true,
-		Message:   "OK",
-		Data:      data,
+	results := make(map[string]*result)
+
+	var commands []*writeCommand
+	var registers []*modbus.ActionRegister
+	values := make(map[*modbus.ActionRegister][]byte)
+
+	for _, identifier := range list {
+		register := modbus.FindRegister(identifier)
+		if register == nil {
+			results[identifier] = failed(newRequestError(codeUnknownIdentifier, fmt.Errorf("找不到匹配的寄存器：%v", identifier)))
+			continue
+		}
+
+		if !register.Access().CanWrite() {
+			results[identifier] = failed(newRequestError(codeReadOnly, fmt.Errorf("只读寄存器无法写入:%v", identifier)))
+			continue
+		}
+
+		switch register.(type) {
+		case *modbus.ActionRegister:
+			ar := register.(*modbus.ActionRegister)
+			val, err := ar.Encode(s.Params)
+			if err != nil {
+				results[identifier] = failed(newRequestError(codeInvalidParam, err))
+				continue
+			}
+			registers = append(registers, ar)
+			values[ar] = val
+		case *modbus.ControlRegister:
+			cr := register.(*modbus.ControlRegister)
+			val, err := cr.Encode(s.Params)
+			if err != nil {
+				results[identifier] = failed(newRequestError(codeInvalidParam, err))
+				continue
+			}
+			cmd := &writeCommand{
+				identifiers: []string{identifier},
+				frame:       cr.NewWriteFrame(id, val),
+				parser:      cr.ParserWriteResp,
+			}
+			// 遥控Switch后通过遥信点1确认开关状态
+			if modbus.IsTelemetering(identifier) {
+				cmd.verifier = verifyTelemetering(id, identifier, val[0])
+			}
+			commands = append(commands, cmd)
+		default:
+			results[identifier] = failed(newRequestError(codeUnsupported, fmt.Errorf("不支持的寄存器类型:%v", reflect.TypeOf(register))))
+		}
 	}
 
-	buf, _ := json.Marshal(resp)
+	if len(results) > 0 {
+		return nil, results, nil
+	}
 
-	log.Info().Str("sn", sn).Interface("resp", resp).Msg("getProperty")
+	// 先写定值再遥控
+	var settings []*writeCommand
+	for _, batch := range modbus.Batch(registers) {
+		cmd := &writeCommand{parser: modbus.ParseMultiWriteResp}
 
-	if token := client.Publish(request.RequestId, mq.AtMostOnce, false, buf); token.Wait() && token.Error() != nil {
-		log.Error().Err(token.Error()).Msg("")
+		var vals [][]byte
+		expected := make(map[string]any)
+		for _, r := range batch {
+			cmd.identifiers = append(cmd.identifiers, r.Name())
+			vals = append(vals, values[r])
+			// 按编码后的值比较，与设备回复的精度一致
+			r.Decode(values[r], expected)
+		}
+
+		cmd.frame = modbus.NewMultiWriteFrame(id, batch, vals)
+		cmd.verifier = verifySettings(id, batch, expected)
+		settings = append(settings, cmd)
 	}
+
+	return append(settings, commands...), results, nil
 }
 
-func (s *setPropertyRequest) Frame() (*modbus.Frame, func(frame *modbus.Frame) (bool, error), error) {
-	if len(s.Identifiers) == 0 {
-		return nil, nil, errors.New("标识符不能为空")
+// do 写入属性，返回每个标识符的结果，设备回复执行失败时为DEVICE_REJECTED
+// 按顺序执行，任一命令失败后不再执行之后的命令，其标识符的结果为NOT_EXECUTED
+func (s *setPropertyRequest) do(gateway *session) (map[string]*result, error) {
+	commands, results, err := s.commands()
+	if err != nil {
+		return nil, err
 	}
 
-	id, err := modbus.NewID(s.ChildDeviceNo)
-	if err != nil {
-		return nil, nil, err
+	for i, cmd := range commands {
+		err := s.write(gateway, cmd)
+
+		if err != nil {
+			for _, identifier := range cmd.identifiers {
+				results[identifier] = failed(err)
+			}
+
+			// 定值写入失败时不再遥控，避免在错误的保护定值下操作开关
+			for _, rest := range commands[i+1:] {
+				for _, identifier := range rest.identifiers {
+					results[identifier] = failed(newRequestError(codeNotExecuted,
+						fmt.Errorf("%v 写入失败，未执行", strings.Join(cmd.identifiers, "、"))))
+				}
+			}
+			break
+		}
+
+		for _, identifier := range cmd.identifiers {
+			results[identifier] = &result{Success: true}
+		}
+
+		if s.Verify {
+			s.verify(gateway, cmd, results)
+		}
 	}
 
-	// 默认只支持单个寄存器写入
-	identifier := s.Identifiers[0]
-	register := modbus.FindRegister(identifier)
-	if register == nil {
-		return nil, nil, fmt.Errorf("找不到匹配的寄存器：%v", identifier)
+	return results, nil
+}
+
+// write 执行一个写命令，设备回复执行失败时返回codeDeviceRejected
+func (s *setPropertyRequest) write(gateway *session, cmd *writeCommand) error {
+	ctx, cancel := context.WithTimeout(gateway.conn.Context(), s.timeout())
+	defer cancel()
+
+	respFrame, err := gateway.do(ctx, cmd.frame)
+	if err != nil {
+		return err
 	}
 
-	var f *modbus.Frame
-	var parser func(frame *modbus.Frame) (bool, error)
+	success, err := cmd.parser(respFrame)
+	if err != nil {
+		return newRequestError(codeInvalidResponse, err)
+	}
 
-	switch register.(type) {
-	case *modbus.ActionRegister:
-		ar := register.(*modbus.ActionRegister)
-		val, err := ar.Encode(s.Params)
-		if err != nil {
-			return nil, nil, err
+	if !success {
+		if cmd.frame.Function == modbus.Telecontrol {
+			return newRequestError(codeDeviceRejected, errors.New("遥控失败"))
 		}
-		f = ar.NewWriteFrame(id, val)
-		parser = ar.ParserWriteResp
-	case *modbus.ControlRegister:
-		cr := register.(*modbus.ControlRegister)
-		val, err := cr.Encode(s.Params)
+		return newRequestError(codeDeviceRejected, errors.New("设备拒绝写入定值"))
+	}
+
+	return nil
+}
+
+// verify 确认写入的结果，读取失败时视为未确认
+// 确认从写入成功后开始计时，不占用写入的超时时间
+func (s *setPropertyRequest) verify(gateway *session, cmd *writeCommand, results map[string]*result) {
+	ctx, cancel := context.WithTimeout(gateway.conn.Context(), s.verifyTimeout())
+	defer cancel()
+
+	var verified map[string]bool
+
+	if cmd.verifier != nil {
+		v, err := cmd.verifier(ctx, gateway)
 		if err != nil {
-			return nil, nil, err
+			log.Error().Err(err).Str("sn", gateway.sn).Strs("identifiers", cmd.identifiers).Msg("确认写入结果")
 		}
-		f = cr.NewWriteFrame(id, val)
-		parser = cr.ParserWriteResp
-	case modbus.RoRegister:
-		return nil, nil, fmt.Errorf("只读寄存器无法写入:%v", identifier)
-	default:
-		return nil, nil, fmt.Errorf("不支持的寄存器类型:%v", reflect.TypeOf(register))
+		verified = v
 	}
 
-	return f, parser, nil
+	for _, identifier := range cmd.identifiers {
+		v := verified[identifier]
+		results[identifier].Verified = &v
+	}
 }
 
 func setProperty(sn string, client mqtt.Client, payload []byte) {
 
 	// 判断sn是否在连接过当前app
-	conn, ok := snConn.Load(sn)
+	gateway, ok := snConn.Load(sn)
 	if !ok {
 		// 设备未在当前应用上线，忽略请求
 		return
@@ -283,56 +644,128 @@ func setProperty(sn string, client mqtt.Client, payload []byte) {
 	var request setPropertyRequest
 
 	if err := json.Unmarshal(payload, &request); err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Str("sn", sn).Msg("setProperty")
+		reply(client, sn, "setProperty", failure(request.RequestId, newRequestError(codeInvalidRequest, err)))
 		return
 	}
 
 	log.Info().Str("sn", sn).Interface("request", request).Msg("setProperty")
 
-	frame, parser, err := request.Frame()
+	results, err := request.do(gateway)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Str("sn", sn).Msg("setProperty")
+		reply(client, sn, "setProperty", failure(request.RequestId, err))
 		return
 	}
 
-	conn.Lock()
-	defer conn.Unlock()
+	resp := summarize(request.RequestId, results)
+	if resp.Success {
+		resp.Message = request.action() + "成功"
+	}
 
-	if err := conn.Write(frame, timeout); err != nil {
-		log.Error().Err(err).Msg("")
-		return
+	if request.Verify {
+		v := verified(results)
+		resp.Verified = &v
+
+		if resp.Success && !v {
+			resp.Message = request.action() + "成功，但读取到的值与写入的不一致"
+		}
 	}
 
-	respFrame, err := conn.Read(size, timeout)
-	if err != nil {
-		log.Error().Err(err).Msg("")
-		return
+	reply(client, sn, "setProperty", resp)
+}
+
+// units 有单位的定值的单位
+func units(data map[string]any) map[string]string {
+	units := make(map[string]string)
+	for identifier := range data {
+		ar, ok := modbus.FindRegister(identifier).(*modbus.ActionRegister)
+		if ok && ar.Unit() != "" {
+			units[identifier] = ar.Unit()
+		}
 	}
+	return units
+}
 
-	success, err := parser(respFrame)
-	if err != nil {
-		log.Error().Err(err).Msg("")
-		return
+// failed 单个标识符失败的结果
+func failed(err error) *result {
+	return &result{
+		Code:    errorCode(err),
+		Message: err.Error(),
 	}
+}
 
-	var message string
+// summarize
+// 所有标识符都成功时请求成功；否则请求失败，错误码取各标识符共同的错误码，部分成功时为PARTIAL_FAILURE
+// 未执行的标识符不影响错误码和message，由导致其未执行的失败决定
+func summarize(requestId string, results map[string]*result) *CommonResponse {
+	resp := &CommonResponse{
+		RequestId: requestId,
+		Success:   true,
+		Results:   results,
+	}
+
+	var failures []string
+	succeeded := false
+	for identifier, r := range results {
+		if r.Success {
+			succeeded = true
+			continue
+		}
+
+		// 总是伴随导致其未执行的失败
+		if r.Code == codeNotExecuted {
+			continue
+		}
+
+		failures = append(failures, identifier)
+		if resp.Code == "" || resp.Code == r.Code {
+			resp.Code = r.Code
+		} else {
+			resp.Code = codeMultiple
+		}
+	}
+
+	if len(failures) == 0 {
+		return resp
+	}
 
-	if success {
-		message = "遥控成功"
+	sort.Strings(failures)
+
+	resp.Success = false
+	if succeeded {
+		resp.Code = codePartialFailure
+	}
+	if len(failures) == 1 {
+		resp.Message = results[failures[0]].Message
 	} else {
-		message = "遥控失败"
+		resp.Message = fmt.Sprintf("%v 执行失败", strings.Join(failures, "、"))
 	}
 
-	resp := &CommonResponse{
-		RequestId: request.RequestId,
-		Success:   success,
-		Message:   message,
+	return resp
+}
+
+// failure 失败的回复，带错误码
+func failure(requestId string, err error) *CommonResponse {
+	return &CommonResponse{
+		RequestId: requestId,
+		Success:   false,
+		Code:      errorCode(err),
+		Message:   err.Error(),
 	}
+}
+
+// reply 发布到请求的RequestId，没有RequestId时无法回复
+func reply(client mqtt.Client, sn string, method string, resp *CommonResponse) {
+	if resp.RequestId == "" {
+		return
+	}
+
 	buf, _ := json.Marshal(resp)
 
-	log.Info().Str("sn", sn).Interface("resp", resp).Msg("setProperty")
+	log.Info().Str("sn", sn).Interface("resp", resp).Msg(method)
 
-	if token := client.Publish(request.RequestId, mq.AtMostOnce, false, buf); token.Wait() && token.Error() != nil {
+	if token := client.Publish(resp.RequestId, mq.AtMostOnce, false, buf); token.Wait() && token.Error() != nil {
 		log.Error().Err(token.Error()).Msg("")
 	}
 }
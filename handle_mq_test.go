@@ -1,24 +1,53 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
 	. "gopkg.in/check.v1"
+	"net"
 	"os"
+	"ricn-smart/jg-gw/modbus"
 	"ricn-smart/jg-gw/mq"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMQ(t *testing.T) {
 	TestingT(t)
 }
 
-type MQTestSuite struct{}
+type MQTestSuite struct {
+	registers []modbus.Register
+}
 
 var _ = Suite(&MQTestSuite{})
 
+// testRegisters 配置了取值范围的寄存器表，默认寄存器表的定值不允许写入
+const testRegisters = `[
+  {"name": "Switch", "type": "control", "address": "0x6001", "access": "wo"},
+  {"name": "OverCurrentTripSetting", "type": "action", "address": "0x8229", "len": 2, "tag": "0x2D", "access": "rw", "unit": "A", "min": 10, "max": 800},
+  {"name": "OverLoadTripSetting", "type": "action", "address": "0x8230", "len": 2, "tag": "0x2D", "access": "rw", "unit": "A", "min": 10, "max": 800},
+  {"name": "LeakageTripSetting", "type": "action", "address": "0x8236", "len": 2, "tag": "0x2D", "access": "rw", "unit": "mA", "allowed": [30, 50, 100, 300]}
+]`
+
+func (s *MQTestSuite) SetUpSuite(c *C) {
+	registers, err := modbus.ParseRegisters([]byte(testRegisters))
+	c.Assert(err, IsNil)
+
+	s.registers = modbus.AllRegister
+	modbus.AllRegister = registers
+}
+
+func (s *MQTestSuite) TearDownSuite(c *C) {
+	modbus.AllRegister = s.registers
+}
+
 const (
 	sn            = "182112180128"
 	childDeviceNo = "072107630289"
@@ -126,3 +155,339 @@ func (s *MQTestSuite) TestGetProperty(c *C) {
 
 	<-quit
 }
+
+func (s *MQTestSuite) TestMultiCommands(c *C) {
+	get := &getPropertyRequest{
+		Identifiers:   []string{"OverCurrentTripSetting", "OverLoadTripSetting", "OverCurrentTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+	}
+
+	reads, results, err := get.commands()
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 0)
+	c.Assert(reads, HasLen, 1)
+	c.Assert(reads[0].identifiers, DeepEquals, []string{"OverCurrentTripSetting", "OverLoadTripSetting"})
+	c.Assert(reads[0].frame.Data[0], Equals, byte(2))
+
+	set := &setPropertyRequest{
+		Identifiers:   []string{"Switch", "OverCurrentTripSetting", "OverLoadTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+		Params: map[string]any{
+			"Switch":                 1,
+			"OverCurrentTripSetting": 70,
+			"OverLoadTripSetting":    60,
+		},
+	}
+
+	writes, results, err := set.commands()
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 0)
+	// 定值合并为一帧，遥控在后
+	c.Assert(writes, HasLen, 2)
+	c.Assert(writes[0].identifiers, DeepEquals, []string{"OverCurrentTripSetting", "OverLoadTripSetting"})
+	c.Assert(writes[1].identifiers, DeepEquals, []string{"Switch"})
+
+	// 任一参数有误时不执行
+	delete(set.Params, "OverLoadTripSetting")
+	writes, results, err = set.commands()
+	c.Assert(err, IsNil)
+	c.Assert(writes, HasLen, 0)
+	c.Assert(results["OverLoadTripSetting"].Code, Equals, codeInvalidParam)
+}
+
+func (s *MQTestSuite) TestTelemetryCommands(c *C) {
+	get := &getPropertyRequest{
+		Identifiers:   []string{"Switch", "Ua", "Leakage", "LeakageProtection", "OverCurrentTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+	}
+
+	reads, results, err := get.commands()
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 0)
+	c.Assert(reads, HasLen, 3)
+
+	// 遥信、遥测各一帧，定值一帧
+	c.Assert(reads[0].identifiers, DeepEquals, []string{"Switch", "LeakageProtection"})
+	c.Assert(reads[0].frame.Function, Equals, modbus.TeleFun)
+	c.Assert(reads[1].identifiers, DeepEquals, []string{"Ua", "Leakage"})
+	c.Assert(reads[1].frame.Function, Equals, modbus.TeleFun)
+	c.Assert(reads[2].identifiers, DeepEquals, []string{"OverCurrentTripSetting"})
+}
+
+func (s *MQTestSuite) TestUnits(c *C) {
+	c.Assert(units(map[string]any{"OverCurrentTripSetting": 70, "Switch": 1, "Ua": "222.8"}), DeepEquals, map[string]string{"OverCurrentTripSetting": "A"})
+}
+
+func (s *MQTestSuite) TestOutOfRange(c *C) {
+	set := &setPropertyRequest{
+		Identifiers:   []string{"OverCurrentTripSetting", "LeakageTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+		Params: map[string]any{
+			"OverCurrentTripSetting": 70,
+			"LeakageTripSetting":     70000,
+		},
+	}
+
+	// 不发送任何帧
+	writes, results, err := set.commands()
+	c.Assert(err, IsNil)
+	c.Assert(writes, HasLen, 0)
+
+	resp := summarize("1", results)
+	c.Assert(resp.Success, Equals, false)
+	c.Assert(resp.Code, Equals, codeInvalidParam)
+	c.Assert(resp.Message, Equals, "参数 LeakageTripSetting 只能为 30mA、50mA、100mA、300mA：70000mA")
+
+	// 默认寄存器表没有取值范围，定值不允许写入
+	registers := modbus.AllRegister
+	modbus.AllRegister = s.registers
+	defer func() {
+		modbus.AllRegister = registers
+	}()
+
+	set.Params["LeakageTripSetting"] = 100
+
+	writes, results, err = set.commands()
+	c.Assert(err, IsNil)
+	c.Assert(writes, HasLen, 0)
+	c.Assert(results["LeakageTripSetting"].Code, Equals, codeInvalidParam)
+	c.Assert(results["LeakageTripSetting"].Message, Equals, "参数 LeakageTripSetting 未配置取值范围，不允许写入")
+}
+
+func (s *MQTestSuite) TestVerifySettings(c *C) {
+	// 过流定值当前为60A
+	d := &fakeDevice{params: map[uint16][]byte{0x8229: {0x29, 0x82, 0x2D, 0x02, 0x3C, 0x00}}}
+	gateway, closeGateway := newGateway(c, d)
+	defer closeGateway()
+
+	set := &setPropertyRequest{
+		Identifiers:   []string{"OverCurrentTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+		Params:        map[string]any{"OverCurrentTripSetting": 70},
+		Verify:        true,
+	}
+
+	results, err := set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(results["OverCurrentTripSetting"].Success, Equals, true)
+	c.Assert(*results["OverCurrentTripSetting"].Verified, Equals, true)
+	c.Assert(verified(results), Equals, true)
+
+	// 回复写入成功但没有保存，读回的仍为70A
+	d.mu.Lock()
+	d.ignore = true
+	d.mu.Unlock()
+
+	set.Params["OverCurrentTripSetting"] = 80
+
+	results, err = set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(results["OverCurrentTripSetting"].Success, Equals, true)
+	c.Assert(*results["OverCurrentTripSetting"].Verified, Equals, false)
+	c.Assert(verified(results), Equals, false)
+}
+
+func (s *MQTestSuite) TestVerifySwitch(c *C) {
+	interval := verifyInterval
+	verifyInterval = 10 * time.Millisecond
+	defer func() {
+		verifyInterval = interval
+	}()
+
+	// 遥控后第3次读取遥信时开关才合上
+	d := &fakeDevice{switching: 2}
+	gateway, closeGateway := newGateway(c, d)
+	defer closeGateway()
+
+	set := &setPropertyRequest{
+		Identifiers:   []string{"Switch"},
+		ChildDeviceNo: childDeviceNo,
+		Params:        map[string]any{"Switch": 1},
+		Verify:        true,
+	}
+
+	results, err := set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(*results["Switch"].Verified, Equals, true)
+
+	d.mu.Lock()
+	c.Assert(d.functions, DeepEquals, []modbus.Function{modbus.Telecontrol, modbus.TeleFun, modbus.TeleFun, modbus.TeleFun})
+	d.mu.Unlock()
+
+	// 确认单独计时，开关动作时间超过写入的超时时间也能确认
+	d.mu.Lock()
+	d.switching = 20
+	d.mu.Unlock()
+
+	set.Params["Switch"] = 0
+	set.Timeout = 50
+	set.VerifyTimeout = 2000
+
+	results, err = set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(*results["Switch"].Verified, Equals, true)
+
+	// 超时前开关状态仍未变化，遥控成功但未确认
+	d.mu.Lock()
+	d.switching = 1000
+	d.mu.Unlock()
+
+	set.Params["Switch"] = 1
+	set.VerifyTimeout = 200
+
+	results, err = set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(results["Switch"].Success, Equals, true)
+	c.Assert(*results["Switch"].Verified, Equals, false)
+}
+
+func (s *MQTestSuite) TestEqual(c *C) {
+	c.Assert(equal(decimal.RequireFromString("70.0"), decimal.NewFromInt(70)), Equals, true)
+	c.Assert(equal(decimal.NewFromInt(60), decimal.NewFromInt(70)), Equals, false)
+	c.Assert(equal(modbus.Number{Decimal: decimal.NewFromInt(70)}, decimal.RequireFromString("70.0")), Equals, true)
+	c.Assert(equal(map[string]bool{"A": true}, map[string]bool{"A": true}), Equals, true)
+	c.Assert(equal(nil, decimal.NewFromInt(70)), Equals, false)
+}
+
+// fakeDevice 模拟集中器，定值写入后可以读回，遥控后经过若干次遥信读取开关状态才变化
+type fakeDevice struct {
+	mu        sync.Mutex
+	params    map[uint16][]byte  // 按信息地址保存的定值
+	reject    bool               // 回复写入定值失败
+	ignore    bool               // 回复写入定值成功但不保存
+	switching int                // 遥控后开关状态保持不变的遥信读取次数
+	pending   byte               // 遥控的目标状态
+	state     byte               // 开关状态
+	functions []modbus.Function  // 收到的请求的功能码
+	nodes     []modbus.ID        // 收到的请求的节点地址
+	mute      map[modbus.ID]bool // 不回复这些节点的请求
+}
+
+// newGateway 通过本地连接连到fakeDevice，返回的函数关闭服务和连接
+func newGateway(c *C, d *fakeDevice) (*session, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	conns := make(chan *modbus.Conn)
+
+	server := modbus.NewServer(listener.Addr().String())
+	server.SetServe(func(ctx context.Context, conn *modbus.Conn) {
+		conns <- conn
+		<-ctx.Done()
+	})
+	go server.Serve(listener)
+
+	rwc, err := net.Dial("tcp", listener.Addr().String())
+	c.Assert(err, IsNil)
+	go d.serve(rwc)
+
+	gateway := &session{conn: <-conns, cfg: defaultConfig().Default}
+
+	return gateway, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		rwc.Close()
+	}
+}
+
+func (d *fakeDevice) serve(rwc net.Conn) {
+	decoder := modbus.NewDecoder(rwc)
+	for {
+		req, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		d.functions = append(d.functions, req.Function)
+		d.nodes = append(d.nodes, req.ID)
+		var resp *modbus.Frame
+		if !d.mute[req.ID] {
+			resp = d.respond(req)
+		}
+		d.mu.Unlock()
+
+		if resp == nil {
+			continue
+		}
+		if _, err := rwc.Write(resp.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (d *fakeDevice) respond(req *modbus.Frame) *modbus.Frame {
+	data := req.Data
+
+	switch req.Function {
+	case modbus.MultiWriteFun:
+		// 数量 数据头(4) 定值区间(2) 特征标识 之后为 地址(2) Tag 长度 值
+		for p := data[8:]; len(p) >= 4; p = p[4+int(p[3]):] {
+			if !d.reject && !d.ignore {
+				d.params[binary.LittleEndian.Uint16(p)] = append([]byte(nil), p[:4+int(p[3])]...)
+			}
+		}
+
+		code := byte(0)
+		if d.reject {
+			code = 1
+		}
+		return &modbus.Frame{Ctrl: modbus.DeviceCtrl80, ID: req.ID, Function: modbus.MultiWriteFun,
+			Data: append(modbus.MultiWriteAckHeader[:], code)}
+
+	case modbus.MultiReadFun:
+		resp := []byte{data[0], 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		for p := data[7:]; len(p) >= 2; p = p[2:] {
+			resp = append(resp, d.params[binary.LittleEndian.Uint16(p)]...)
+		}
+		return &modbus.Frame{Ctrl: modbus.DeviceCtrl83, ID: req.ID, Function: modbus.MultiReadFun, Data: resp}
+
+	case modbus.Telecontrol:
+		d.pending = data[7]
+		return &modbus.Frame{Ctrl: modbus.DeviceCtrl80, ID: req.ID, Function: modbus.Telecontrol,
+			Data: append(append(modbus.TelecontrolAckHeader[:], data[5:7]...), 0x00)}
+
+	case modbus.TeleFun:
+		if d.switching > 0 {
+			d.switching--
+		} else {
+			d.state = d.pending
+		}
+
+		resp := append(modbus.TelemeteringAckHeader[:], make([]byte, 26)...)
+		resp[8] = d.state // 遥信点1为开关状态
+		return &modbus.Frame{Ctrl: modbus.DeviceCtrl88, ID: req.ID, Function: modbus.TeleFun, Data: resp}
+	}
+
+	return nil
+}
+
+func (s *MQTestSuite) TestStopAfterFailure(c *C) {
+	d := &fakeDevice{params: make(map[uint16][]byte), reject: true}
+	gateway, closeGateway := newGateway(c, d)
+	defer closeGateway()
+
+	set := &setPropertyRequest{
+		Identifiers:   []string{"Switch", "OverCurrentTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+		Params: map[string]any{
+			"Switch":                 1,
+			"OverCurrentTripSetting": 70,
+		},
+	}
+
+	results, err := set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(results["OverCurrentTripSetting"].Code, Equals, codeDeviceRejected)
+	c.Assert(results["OverCurrentTripSetting"].Message, Equals, "设备拒绝写入定值")
+	c.Assert(results["Switch"].Code, Equals, codeNotExecuted)
+
+	c.Assert(set.action(), Equals, "写入")
+	c.Assert(setControlRequest.action(), Equals, "遥控")
+
+	// 定值写入失败后没有遥控
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.Assert(d.functions, DeepEquals, []modbus.Function{modbus.MultiWriteFun})
+}
@@ -1,21 +1,50 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"io"
 	"os"
 	"ricn-smart/jg-gw/modbus"
 	"ricn-smart/jg-gw/mq"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const timeout = 60 * time.Second // 据观察，京硅设备心跳间隔在60s以内
+
+// 下线原因
 const (
-	timeout = 60 * time.Second // 据观察，京硅设备心跳间隔在60s以内
-	size    = 500              // 设定读取数据的最大长度，必须大于设备发送的数据长度
+	reasonEOF              = "EOF"               // 集中器断开连接
+	reasonError            = "ERROR"             // 连接出错
+	reasonHeartbeatTimeout = "HEARTBEAT_TIMEOUT" // 超时未收到心跳
+	reasonReplaced         = "REPLACED"          // 集中器在新的连接上重新注册
+	reasonShutdown         = "SHUTDOWN"          // 服务关闭
+	reasonPowerDown        = "POWER_DOWN"        // 集中器上报掉电后断开
 )
 
-func handler(conn *modbus.Conn) {
+// session 一个集中器连接的状态
+type session struct {
+	conn          *modbus.Conn
+	sn            string        // 注册后才有，第一次注册后不再改变，命令和轮询协程不加锁读取
+	cfg           gatewayConfig // 同sn
+	lastHeartbeat time.Time     // 最近一次收到注册或心跳的时间
+	poweredDown   atomic.Bool   // 集中器上报掉电后，节点视为失电而不是离线，轮询协程也会读取
+
+	mu    sync.Mutex
+	nodes []modbus.ID // 最近一次心跳中的节点
+
+	// priority 命令优先于轮询：命令执行期间持有读锁，轮询的每个请求都需要写锁
+	priority sync.RWMutex
+
+	scheduler *scheduler
+}
+
+func handler(ctx context.Context, conn *modbus.Conn) {
 	blackList := os.Getenv("BLACK_LIST")
 	for _, ip := range strings.Split(blackList, ",") {
 		if strings.Split(conn.Addr().String(), ":")[0] == ip {
@@ -23,115 +52,325 @@ func handler(conn *modbus.Conn) {
 		}
 	}
 
+	s := &session{
+		conn:          conn,
+		cfg:           conf.gateway(""),
+		lastHeartbeat: time.Now(),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	reason := s.serve(ctx)
+
+	// 停止轮询
+	cancel()
+	if s.scheduler != nil {
+		s.scheduler.wait()
+	}
+
+	s.offline(reason)
+}
+
+// serve 处理集中器上报的帧，返回下线原因
+func (s *session) serve(ctx context.Context) string {
+	conn := s.conn
+
 	for {
-		func(conn *modbus.Conn) {
-			conn.Lock()
-			defer conn.Unlock()
-			f, err := conn.Read(size, timeout)
+		// 心跳看门狗
+		readCtx, cancel := context.WithDeadline(ctx, s.lastHeartbeat.Add(time.Duration(s.cfg.HeartbeatTimeout)))
+		f, err := conn.ReadFrame(readCtx)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("sn", s.sn).Str("remote", conn.Addr().String()).Msg("")
+			switch {
+			case ctx.Err() != nil:
+				return reasonShutdown
+			case errors.Is(err, context.DeadlineExceeded):
+				return reasonHeartbeatTimeout
+			case errors.Is(err, io.EOF):
+				return reasonEOF
+			default:
+				return reasonError
+			}
+		}
+
+		switch f.Function {
+		case modbus.RegisterFun:
+			login, err := f.NewLogin()
 			if err != nil {
 				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-				return
+				continue
 			}
 
-			switch f.Function {
-			case modbus.RegisterFun:
-				login, err := f.NewLogin()
-				if err != nil {
-					log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-					return
-				}
-
-				sn := login.ID.String()
-
-				log.Info().Str("sn", sn).Msg("上线")
-
-				mq.Publish(ProjectName+"/"+sn+"/event", mq.ExactlyOnce, false, map[string]any{"Identifier": "ONLINE"})
-
-				snConn.Store(sn, conn)
-
-			case modbus.HeartBeatFun:
-				heartBeat, err := f.NewHeartBeat()
-				if err != nil {
-					log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-					return
-				}
-
-				// 扩展规约 6.1 原样回复给集中器
-				if err := conn.Write(f, timeout); err != nil {
-					log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-					return
-				}
-
-				sn := heartBeat.ID.String()
-
-				log.Debug().Str("sn", sn).Str("node", modbus.NodesString(heartBeat.NodeIDs)).Msg("心跳包")
-
-				for _, id := range heartBeat.NodeIDs {
-					// 遥信读取开关状态
-					if err := conn.Write(modbus.NewTelemetering(id), timeout); err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					telemeterAckFrame, err := conn.Read(size, timeout)
-					if err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					data := make(map[string]any)
-
-					if err := telemeterAckFrame.NewTelemeteringAck(data); err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					// 遥测读取电压等数据
-					if err := conn.Write(modbus.NewTeleindication(id), timeout); err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					teleindicationAckFrame, err := conn.Read(size, timeout)
-					if err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					if err := teleindicationAckFrame.NewTeleindicationAck(data); err != nil {
-						log.Error().Err(err).Str("sn", sn).Str("node", id.String()).Msg("")
-						return
-					}
-
-					log.Debug().Str("sn", sn).Interface("data", data).Str("node", id.String()).Msg("开关和模拟量")
-
-					mq.Publish(ProjectName+"/"+sn+"/"+id.String()+"/property", mq.AtMostOnce, false, data)
-				}
-
-			case modbus.PowerDownFun:
-				log.Debug().Msg("掉电")
-			case modbus.FaultFun:
-				fault, err := f.NewFault()
-				if err != nil {
-					log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-					return
-				}
-				log.Debug().Time("time", fault.TelemeteringTimeMark.Time()).Msg("故障")
-				faultAckFrame := f.NewFaultAck(fault)
-				// 回复确认
-				if err := conn.Write(faultAckFrame, timeout); err != nil {
-					log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
-					return
-				}
-			case modbus.TeleFun:
-				// 设备接收到其他途径（比如：485）的下发命令，会把其他途径下发的命令也发送给主站
-				log.Debug().Msg("设备收到其他途径的遥信")
+			s.login(login.ID.String())
 
-			default:
-				log.Debug().Str("remote", conn.Addr().String()).Str("Function", fmt.Sprintf("0x%X", f.Function)).Str("Ctrl", fmt.Sprintf("0x%X", f.Ctrl)).Msg("未处理的命令码")
+			if s.scheduler == nil {
+				s.scheduler = newScheduler(s, s.sn, s.cfg)
+				s.scheduler.start(ctx)
+			}
+
+		case modbus.HeartBeatFun:
+			heartBeat, err := f.NewHeartBeat()
+			if err != nil {
+				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
+				continue
+			}
+
+			s.lastHeartbeat = time.Now()
+			s.setNodes(heartBeat.NodeIDs)
+
+			if s.poweredDown.CompareAndSwap(true, false) {
+				log.Info().Str("sn", s.sn).Msg("恢复供电")
+				publishEvent(s.sn, "POWER_RESTORED", nil)
+			}
+
+			// 扩展规约 6.1 原样回复给集中器
+			if err := write(conn, f); err != nil {
+				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
+				continue
+			}
+
+			log.Debug().Str("sn", heartBeat.ID.String()).Str("node", modbus.NodesString(heartBeat.NodeIDs)).Msg("心跳包")
+
+		case modbus.PowerDownFun:
+			powerDown, err := f.NewPowerDown()
+			if err != nil {
+				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
+				continue
+			}
+
+			s.powerDown(powerDown)
+		case modbus.FaultFun:
+			fault, err := f.NewFault()
+			if err != nil {
+				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
+				continue
 			}
-		}(conn)
-		// 为接收请求留下时间
-		time.Sleep(10 * time.Second)
+			s.fault(f.ID, fault)
+
+			faultAckFrame := modbus.NewFaultAck(f.ID, fault)
+			// 回复确认
+			if err := write(conn, faultAckFrame); err != nil {
+				log.Error().Err(err).Str("remote", conn.Addr().String()).Msg("")
+				continue
+			}
+		case modbus.TeleFun:
+			// 设备接收到其他途径（比如：485、本地操作）的下发命令，会把其他途径下发的命令也发送给主站
+			// 请求的回复已由conn分发，到这里的回复是超时请求迟到的回复
+			s.external(f)
+
+		default:
+			log.Debug().Str("remote", conn.Addr().String()).Str("Function", fmt.Sprintf("0x%X", f.Function)).Str("Ctrl", fmt.Sprintf("0x%X", f.Ctrl)).Msg("未处理的命令码")
+		}
+	}
+}
+
+func (s *session) login(sn string) {
+	// 发布到snConn之前设置，之后读取sn和cfg的协程都能看到
+	if s.sn == "" {
+		s.sn = sn
+		s.cfg = conf.gateway(sn)
+	} else if sn != s.sn {
+		log.Error().Str("sn", s.sn).Str("new", sn).Str("remote", s.conn.Addr().String()).Msg("同一连接上以不同的sn注册，忽略")
+		return
+	}
+
+	s.lastHeartbeat = time.Now()
+
+	log.Info().Str("sn", sn).Msg("上线")
+
+	previous, ok := snConn.Swap(sn, s)
+	if !ok || previous == s {
+		publishEvent(sn, "ONLINE", nil)
+		if !ok {
+			publishSns()
+		}
+		return
+	}
+
+	// 集中器在新的连接上重新注册（NAT重新绑定、4G DTU重连等），旧连接多半已经半开，关闭旧连接释放资源
+	// 旧连接结束时发现已被替换，不会再发布下线事件
+	lifetime := time.Since(previous.conn.ConnectedAt())
+
+	log.Warn().Str("sn", sn).Str("remote", s.conn.Addr().String()).Str("previous", previous.conn.Addr().String()).
+		Dur("lifetime", lifetime).Msg("重复注册，关闭旧连接")
+
+	if err := previous.conn.Close(); err != nil {
+		log.Error().Err(err).Str("sn", sn).Str("remote", previous.conn.Addr().String()).Msg("")
+	}
+
+	publishEvent(sn, "OFFLINE", map[string]any{"Reason": reasonReplaced})
+	publishEvent(sn, "ONLINE", nil)
+	publishEvent(sn, "RECONNECTED", map[string]any{
+		"Remote":           s.conn.Addr().String(),
+		"PreviousRemote":   previous.conn.Addr().String(),
+		"PreviousLifetime": int64(lifetime.Seconds()), // 旧连接存续时间，单位秒
+	})
+}
+
+// powerDown
+// 集中器掉电，其下的节点随之失电，区别于网络中断导致的离线
+func (s *session) powerDown(p *modbus.PowerDown) {
+	sn := s.sn
+	if sn == "" {
+		sn = p.ID.String()
+	}
+
+	nodes := p.NodeIDs
+	if len(nodes) == 0 {
+		nodes = s.Nodes()
 	}
+
+	s.poweredDown.Store(true)
+
+	log.Warn().Str("sn", sn).Str("node", modbus.NodesString(nodes)).Msg("掉电")
+
+	var nodeIDs []string
+	for _, id := range nodes {
+		nodeIDs = append(nodeIDs, id.String())
+	}
+
+	publishEvent(sn, "POWER_DOWN", map[string]any{"Nodes": nodeIDs})
+}
+
+// fault 每个故障遥信点发布一个节点故障事件
+func (s *session) fault(id modbus.ID, fault *modbus.Fault) {
+	analogs := fault.Analogs()
+
+	for _, p := range fault.Telemetering {
+		params := map[string]any{
+			"Point":   p.Name(),
+			"Value":   p.Value,
+			"Analogs": analogs,
+		}
+
+		// 故障时标，设备未填写时标时不发布
+		if t := p.TimeMark.Time(); !t.IsZero() {
+			params["FaultTime"] = t.UnixMilli()
+		}
+
+		log.Info().Str("sn", s.sn).Str("node", id.String()).Interface("params", params).Msg("故障")
+
+		if s.sn == "" {
+			log.Warn().Str("remote", s.conn.Addr().String()).Str("node", id.String()).Msg("集中器未注册，不发布故障")
+			continue
+		}
+
+		publishNodeEvent(s.sn, id.String(), "FAULT", params)
+	}
+}
+
+// external
+// 其他途径引起的遥信、遥测变化，立即发布，不等下一次轮询
+// 只发布传送原因为突发的帧，迟到的回复丢弃，对应的请求已按失败处理
+func (s *session) external(f *modbus.Frame) {
+	if cause := f.Cause(); cause != modbus.CauseSpontaneous {
+		log.Warn().Str("sn", s.sn).Str("node", f.ID.String()).Str("cause", fmt.Sprintf("0x%X", cause)).Msg("迟到的回复，丢弃")
+		return
+	}
+
+	data := make(map[string]any)
+
+	if err := f.NewSpontaneous(data); err != nil {
+		log.Error().Err(err).Str("sn", s.sn).Str("node", f.ID.String()).Msg("无法解析其他途径的遥信、遥测")
+		return
+	}
+
+	log.Info().Str("sn", s.sn).Str("node", f.ID.String()).Interface("data", data).Msg("其他途径的遥信、遥测")
+
+	if s.sn == "" {
+		return
+	}
+
+	now := time.Now()
+
+	updateShadow(s.sn, f.ID.String(), data, now, time.Duration(s.cfg.Report.Integrity))
+
+	data["source"] = "external"
+	data["Time"] = now.UnixMilli()
+
+	mq.Publish(ProjectName+"/"+s.sn+"/"+f.ID.String()+"/property", mq.AtMostOnce, false, data)
+}
+
+// offline 连接结束时发布下线事件，集中器已在新连接上注册时不发布
+func (s *session) offline(reason string) {
+	if s.sn == "" {
+		return
+	}
+
+	if !snConn.CompareAndDelete(s.sn, s) {
+		log.Info().Str("sn", s.sn).Str("remote", s.conn.Addr().String()).Str("reason", reason).Msg("旧连接结束")
+		return
+	}
+
+	// 掉电后集中器随即断开，不是网络故障
+	if s.poweredDown.Load() && (reason == reasonEOF || reason == reasonError || reason == reasonHeartbeatTimeout) {
+		reason = reasonPowerDown
+	}
+
+	log.Info().Str("sn", s.sn).Str("reason", reason).Msg("下线")
+
+	publishEvent(s.sn, "OFFLINE", map[string]any{"Reason": reason})
+	publishSns()
+}
+
+// publishEvent 发布集中器事件
+func publishEvent(sn string, identifier string, params map[string]any) {
+	mq.Publish(ProjectName+"/"+sn+"/event", mq.ExactlyOnce, false, newEvent(identifier, params))
+}
+
+// publishNodeEvent 发布节点事件
+func publishNodeEvent(sn string, node string, identifier string, params map[string]any) {
+	mq.Publish(ProjectName+"/"+sn+"/"+node+"/event", mq.ExactlyOnce, false, newEvent(identifier, params))
+}
+
+func newEvent(identifier string, params map[string]any) map[string]any {
+	event := map[string]any{
+		"Identifier": identifier,
+		"Time":       time.Now().UnixMilli(),
+	}
+
+	if params != nil {
+		event["Params"] = params
+	}
+
+	return event
+}
+
+func write(conn *modbus.Conn, f *modbus.Frame) error {
+	ctx, cancel := context.WithTimeout(conn.Context(), timeout)
+	defer cancel()
+	return conn.WriteFrame(ctx, f)
+}
+
+// do 执行命令，命令优先于轮询
+func (s *session) do(ctx context.Context, f *modbus.Frame) (*modbus.Frame, error) {
+	s.priority.RLock()
+	defer s.priority.RUnlock()
+
+	return s.conn.Do(ctx, f)
+}
+
+// poll 执行轮询请求，有命令在执行时等待命令完成
+func (s *session) poll(f *modbus.Frame, timeout time.Duration) (*modbus.Frame, error) {
+	s.priority.Lock()
+	defer s.priority.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.conn.Context(), timeout)
+	defer cancel()
+
+	return s.conn.Do(ctx, f)
+}
+
+// Nodes 集中器下的节点
+func (s *session) Nodes() []modbus.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodes
+}
+
+func (s *session) setNodes(nodes []modbus.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = nodes
 }
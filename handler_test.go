@@ -0,0 +1,137 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"ricn-smart/jg-gw/modbus"
+	"time"
+)
+
+type HandlerTestSuite struct{}
+
+var _ = Suite(&HandlerTestSuite{})
+
+func (s *HandlerTestSuite) TestReplaced(c *C) {
+	fake, restore := installClient()
+	defer restore()
+
+	previous, closePrevious := newGateway(c, &fakeDevice{})
+	defer closePrevious()
+
+	current, closeCurrent := newGateway(c, &fakeDevice{})
+	defer closeCurrent()
+
+	defer snConn.Delete(sn)
+
+	topic := ProjectName + "/" + sn + "/event"
+
+	previous.login(sn)
+	current.login(sn)
+
+	// 旧连接被关闭
+	select {
+	case <-previous.conn.Context().Done():
+	case <-time.After(time.Second):
+		c.Fatal("previous connection is not closed")
+	}
+
+	c.Assert(fake.identifiers(topic), DeepEquals, []string{"ONLINE", "OFFLINE", "ONLINE", "RECONNECTED"})
+
+	events := fake.published(topic)
+	c.Assert(events[1].payload["Params"], DeepEquals, map[string]any{"Reason": reasonReplaced})
+	c.Assert(events[3].payload["Params"].(map[string]any)["PreviousRemote"], Equals, previous.conn.Addr().String())
+
+	// 旧连接结束时不再发布下线事件
+	previous.offline(reasonEOF)
+	c.Assert(fake.identifiers(topic), HasLen, 4)
+
+	gateway, ok := snConn.Load(sn)
+	c.Assert(ok, Equals, true)
+	c.Assert(gateway, Equals, current)
+
+	current.offline(reasonEOF)
+	c.Assert(fake.identifiers(topic), DeepEquals, []string{"ONLINE", "OFFLINE", "ONLINE", "RECONNECTED", "OFFLINE"})
+	_, ok = snConn.Load(sn)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *HandlerTestSuite) TestRelogin(c *C) {
+	_, restore := installClient()
+	defer restore()
+
+	gateway, closeGateway := newGateway(c, &fakeDevice{})
+	defer closeGateway()
+
+	defer snConn.Delete(sn)
+	defer func() {
+		shadows.mu.Lock()
+		delete(shadows.m, sn+"/"+childDeviceNo)
+		shadows.mu.Unlock()
+	}()
+
+	gateway.login(sn)
+
+	// 集中器在同一连接上重复注册时，命令协程仍在读取sn和配置，go test -race 检查
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			gateway.login(sn)
+		}
+		gateway.login("182112180129")
+	}()
+
+	get := &getPropertyRequest{
+		Identifiers:   []string{"Switch", "OverCurrentTripSetting"},
+		ChildDeviceNo: childDeviceNo,
+	}
+	for i := 0; i < 20; i++ {
+		_, _, err := get.do(gateway)
+		c.Assert(err, IsNil)
+	}
+
+	<-done
+
+	// 以不同的sn注册被忽略
+	c.Assert(gateway.sn, Equals, sn)
+	_, ok := snConn.Load("182112180129")
+	c.Assert(ok, Equals, false)
+}
+
+// telemeteringFrame 终端发出的遥信帧，开关状态为state
+func telemeteringFrame(c *C, cause byte, state byte) *modbus.Frame {
+	id, err := modbus.NewID(childDeviceNo)
+	c.Assert(err, IsNil)
+
+	data := make([]byte, 8+26)
+	copy(data, modbus.TelemeteringAckHeader[:])
+	data[1] = cause
+	data[8] = state
+
+	return &modbus.Frame{Ctrl: modbus.DeviceCtrl88, ID: id, Function: modbus.TeleFun, Data: data}
+}
+
+func (s *HandlerTestSuite) TestExternal(c *C) {
+	fake, restore := installClient()
+	defer restore()
+
+	defer func() {
+		shadows.mu.Lock()
+		delete(shadows.m, sn+"/"+childDeviceNo)
+		shadows.mu.Unlock()
+	}()
+
+	gateway := &session{sn: sn, cfg: defaultConfig().Default}
+	topic := ProjectName + "/" + sn + "/" + childDeviceNo + "/property"
+
+	// 超时轮询迟到的回复，不发布
+	gateway.external(telemeteringFrame(c, modbus.CauseActivationCon, 1))
+	c.Assert(fake.published(topic), HasLen, 0)
+
+	// 本地操作引起的突发上报
+	gateway.external(telemeteringFrame(c, modbus.CauseSpontaneous, 0))
+
+	messages := fake.published(topic)
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].payload["source"], Equals, "external")
+	c.Assert(messages[0].payload["Switch"], Equals, float64(0))
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"net/http"
 	"os"
 	"os/signal"
 	logger "ricn-smart/jg-gw/log"
@@ -10,9 +14,13 @@ import (
 	"ricn-smart/jg-gw/mq"
 	"ricn-smart/jg-gw/util"
 	"syscall"
+	"time"
 )
 
-const port = 65010
+const (
+	port            = 65010
+	shutdownTimeout = 30 * time.Second // 等待进行中的请求和发布完成的最长时间
+)
 
 var (
 	GitCommitID string
@@ -28,6 +36,23 @@ func init() {
 
 	logger.Init(debug, fmt.Sprintf("log/%v.log", ProjectName))
 
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config.json"
+	}
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	conf = c
+
+	// 未指定时使用内置的寄存器表
+	if registersFile := os.Getenv("REGISTERS_FILE"); registersFile != "" {
+		if err := modbus.LoadRegisterFile(registersFile); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
 }
 
 func main() {
@@ -41,14 +66,37 @@ func main() {
 	// 因为会有多个应用实例运行在不同的主机上，因此不能使用可能重复的GitCommitID作为客户端ID
 	opts := mq.Init(clientID)
 	opts.SetOnConnectHandler(handleMQConn)
+
+	// 实例异常退出时由代理发布遗嘱，云端据此将该实例的集中器标记为离线
+	instanceID = clientID
+	will, _ := json.Marshal(willPayload())
+	opts.SetWill(statusTopic(), string(will), mq.AtLeastOnce, true)
+
+	// 代理不可达时TCP服务照常运行，事件暂存在消息队列中
+	mq.SetStateHandler(func(connected bool) {
+		if connected {
+			log.Info().Msg("MQTT已连接")
+		} else {
+			log.Warn().Msg("MQTT未连接，事件将缓存至重新连接")
+		}
+	})
 	mq.Connect(opts)
 
+	// 通过 /debug/vars 查看消息队列等指标
+	if addr := os.Getenv("METRICS_ADDRESS"); addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Error().Err(err).Msg("")
+			}
+		}()
+	}
+
 	server := modbus.NewServer(fmt.Sprintf(":%v", port))
 
 	server.SetServe(handler)
 
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, modbus.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("")
 		}
 	}()
@@ -56,7 +104,32 @@ func main() {
 	log.Info().Str("commit", GitCommitID).
 		Bool("debug", debug).Int("port", port).Str("clientID", clientID).Msg(ProjectName + " started")
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
 	<-quit
+
+	log.Info().Msg(ProjectName + " shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("")
+	}
+
+	// 正常情况下各连接在serve返回时已经发布了下线事件，这里处理等待超时后被强制关闭的连接
+	snConn.Range(func(sn string, s *session) bool {
+		if snConn.CompareAndDelete(sn, s) {
+			log.Info().Str("sn", sn).Str("reason", reasonShutdown).Msg("下线")
+			publishEvent(sn, "OFFLINE", map[string]any{"Reason": reasonShutdown})
+		}
+		return true
+	})
+
+	// 正常关闭不会触发遗嘱，主动发布
+	publishSns()
+	publishStatus(instanceOffline, reasonShutdown)
+
+	deadline, _ := ctx.Deadline()
+	mq.Close(time.Until(deadline))
 }
@@ -0,0 +1,336 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+	"strings"
+)
+
+// Tag类型，见扩展规约 附件1：数据类型
+const (
+	TagBool    byte = 1
+	TagInt32   byte = 2
+	TagString  byte = 4
+	TagUint8   byte = 32
+	TagInt16   byte = 33
+	TagUint32  byte = 35
+	TagFloat32 byte = 38
+	TagFloat64 byte = 39
+	TagInt8    byte = 43
+	TagUint16  byte = 45
+)
+
+// Codec
+// 参数值的编解码，数值类型解码为decimal.Decimal，编码时也传入decimal.Decimal（原始值，未乘系数）
+type Codec interface {
+	// Size 数据长度，0表示变长
+	Size() int
+
+	Decode(b []byte) (any, error)
+
+	// Encode n为寄存器的数据长度
+	Encode(v any, n int) ([]byte, error)
+}
+
+// Numeric 数值类型的Codec，寄存器的系数和范围只对数值类型生效
+type Numeric interface {
+	Codec
+
+	// Range 原始值的范围
+	Range() (min, max decimal.Decimal)
+
+	// Integer 原始值是否只能为整数
+	Integer() bool
+}
+
+var (
+	// codecs 按Tag类型
+	codecs = map[byte]Codec{
+		TagBool:    boolCodec{},
+		TagInt8:    intCodec{size: 1, signed: true},
+		TagUint8:   intCodec{size: 1},
+		TagInt16:   intCodec{size: 2, signed: true},
+		TagUint16:  intCodec{size: 2},
+		TagInt32:   intCodec{size: 4, signed: true},
+		TagUint32:  intCodec{size: 4},
+		TagFloat32: floatCodec{size: 4},
+		TagFloat64: floatCodec{size: 8},
+		TagString:  stringCodec{},
+	}
+
+	// formats 按名称，寄存器表中用format指定，覆盖Tag类型的默认解释
+	formats = map[string]Codec{
+		"bcd":   bcdCodec{},
+		"bytes": bytesCodec{},
+	}
+)
+
+// RegisterCodec 注册Tag类型的Codec，应在加载寄存器表之前调用
+func RegisterCodec(tag byte, codec Codec) {
+	codecs[tag] = codec
+}
+
+// RegisterFormat 注册命名的Codec，应在加载寄存器表之前调用
+func RegisterFormat(name string, codec Codec) {
+	formats[name] = codec
+}
+
+// CodecOf 返回Tag类型的Codec
+func CodecOf(tag byte) (Codec, bool) {
+	c, ok := codecs[tag]
+	return c, ok
+}
+
+type boolCodec struct{}
+
+func (boolCodec) Size() int {
+	return 1
+}
+
+func (boolCodec) Decode(b []byte) (any, error) {
+	if len(b) != 1 {
+		return nil, fmt.Errorf("bool expect 1 byte, got %v", len(b))
+	}
+	return b[0] != 0, nil
+}
+
+func (boolCodec) Encode(v any, _ int) ([]byte, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	default:
+		return nil, fmt.Errorf("期望布尔值，实际：%T", v)
+	}
+}
+
+// intCodec 小端整数
+type intCodec struct {
+	size   int
+	signed bool
+}
+
+func (c intCodec) Size() int {
+	return c.size
+}
+
+func (c intCodec) Integer() bool {
+	return true
+}
+
+func (c intCodec) Range() (decimal.Decimal, decimal.Decimal) {
+	bits := c.size * 8
+	if c.signed {
+		return decimal.NewFromInt(-1 << (bits - 1)), decimal.NewFromInt(1<<(bits-1) - 1)
+	}
+	return decimal.Zero, decimal.NewFromInt(int64(uint64(1)<<bits - 1))
+}
+
+func (c intCodec) Decode(b []byte) (any, error) {
+	if len(b) != c.size {
+		return nil, fmt.Errorf("integer expect %v bytes, got %v", c.size, len(b))
+	}
+
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+
+	if c.signed {
+		// 符号扩展
+		shift := 64 - c.size*8
+		return decimal.NewFromInt(int64(u<<shift) >> shift), nil
+	}
+
+	return decimal.NewFromInt(int64(u)), nil
+}
+
+func (c intCodec) Encode(v any, _ int) ([]byte, error) {
+	d, ok := v.(decimal.Decimal)
+	if !ok {
+		return nil, fmt.Errorf("期望数值，实际：%T", v)
+	}
+
+	if !d.IsInteger() {
+		return nil, fmt.Errorf("期望整数，实际：%v", d)
+	}
+
+	min, max := c.Range()
+	if d.LessThan(min) || d.GreaterThan(max) {
+		return nil, fmt.Errorf("超出范围 %v ~ %v：%v", min, max, d)
+	}
+
+	u := uint64(d.IntPart())
+	b := make([]byte, c.size)
+	for i := range b {
+		b[i] = byte(u >> (8 * i))
+	}
+	return b, nil
+}
+
+// floatCodec 小端IEEE 754浮点数
+type floatCodec struct {
+	size int
+}
+
+func (c floatCodec) Size() int {
+	return c.size
+}
+
+func (c floatCodec) Integer() bool {
+	return false
+}
+
+func (c floatCodec) Range() (decimal.Decimal, decimal.Decimal) {
+	if c.size == 4 {
+		return decimal.NewFromFloat(-math.MaxFloat32), decimal.NewFromFloat(math.MaxFloat32)
+	}
+	return decimal.NewFromFloat(-math.MaxFloat64), decimal.NewFromFloat(math.MaxFloat64)
+}
+
+func (c floatCodec) Decode(b []byte) (any, error) {
+	if len(b) != c.size {
+		return nil, fmt.Errorf("float expect %v bytes, got %v", c.size, len(b))
+	}
+
+	var f float64
+	if c.size == 4 {
+		f = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	} else {
+		f = math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("invalid float %v", f)
+	}
+
+	return decimal.NewFromFloat(f), nil
+}
+
+func (c floatCodec) Encode(v any, _ int) ([]byte, error) {
+	d, ok := v.(decimal.Decimal)
+	if !ok {
+		return nil, fmt.Errorf("期望数值，实际：%T", v)
+	}
+
+	f, _ := d.Float64()
+
+	b := make([]byte, c.size)
+	if c.size == 4 {
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f)))
+	} else {
+		binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+	}
+	return b, nil
+}
+
+// stringCodec 定长字符串，不足的部分补0
+type stringCodec struct{}
+
+func (stringCodec) Size() int {
+	return 0
+}
+
+func (stringCodec) Decode(b []byte) (any, error) {
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+func (stringCodec) Encode(v any, n int) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("期望字符串，实际：%T", v)
+	}
+
+	if len(s) > n {
+		return nil, fmt.Errorf("字符串长度不能超过 %v 字节：%v", n, s)
+	}
+
+	b := make([]byte, n)
+	copy(b, s)
+	return b, nil
+}
+
+// bytesCodec 字节数组，以十六进制字符串表示
+type bytesCodec struct{}
+
+func (bytesCodec) Size() int {
+	return 0
+}
+
+func (bytesCodec) Decode(b []byte) (any, error) {
+	return strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+func (bytesCodec) Encode(v any, n int) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("期望十六进制字符串，实际：%T", v)
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != n {
+		return nil, fmt.Errorf("期望 %v 字节，实际：%v", n, len(b))
+	}
+	return b, nil
+}
+
+// bcdCodec 小端BCD码，每字节两位十进制数
+type bcdCodec struct{}
+
+func (bcdCodec) Size() int {
+	return 0
+}
+
+func (bcdCodec) Integer() bool {
+	return true
+}
+
+// Range 最多8字节，超过int64范围的部分不支持
+func (bcdCodec) Range() (decimal.Decimal, decimal.Decimal) {
+	return decimal.Zero, decimal.New(1, 16).Sub(decimal.NewFromInt(1))
+}
+
+func (bcdCodec) Decode(b []byte) (any, error) {
+	var v int64
+	for i := len(b) - 1; i >= 0; i-- {
+		hi, lo := b[i]>>4, b[i]&0x0F
+		if hi > 9 || lo > 9 {
+			return nil, fmt.Errorf("invalid BCD % X", b)
+		}
+		v = v*100 + int64(hi)*10 + int64(lo)
+	}
+	return decimal.NewFromInt(v), nil
+}
+
+func (bcdCodec) Encode(v any, n int) ([]byte, error) {
+	d, ok := v.(decimal.Decimal)
+	if !ok {
+		return nil, fmt.Errorf("期望数值，实际：%T", v)
+	}
+
+	if !d.IsInteger() || d.IsNegative() {
+		return nil, fmt.Errorf("期望非负整数，实际：%v", d)
+	}
+
+	u := d.IntPart()
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(u%100/10<<4 | u%10)
+		u /= 100
+	}
+
+	if u != 0 {
+		return nil, errors.New("超出BCD码的位数")
+	}
+	return b, nil
+}
@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	"github.com/shopspring/decimal"
+	. "gopkg.in/check.v1"
+)
+
+type CodecTestSuite struct{}
+
+var _ = Suite(&CodecTestSuite{})
+
+func (s *CodecTestSuite) TestInteger(c *C) {
+	codec, _ := CodecOf(TagInt16)
+
+	v, err := codec.Decode([]byte{0xFE, 0xFF})
+	c.Assert(err, IsNil)
+	c.Assert(v.(decimal.Decimal).String(), Equals, "-2")
+
+	b, err := codec.Encode(decimal.NewFromInt(-2), 2)
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0xFE, 0xFF})
+
+	_, err = codec.Encode(decimal.NewFromInt(40000), 2)
+	c.Assert(err, NotNil)
+
+	codec, _ = CodecOf(TagUint32)
+	v, err = codec.Decode([]byte{0x01, 0x00, 0x00, 0x80})
+	c.Assert(err, IsNil)
+	c.Assert(v.(decimal.Decimal).String(), Equals, "2147483649")
+}
+
+func (s *CodecTestSuite) TestFloat(c *C) {
+	codec, _ := CodecOf(TagFloat32)
+
+	b, err := codec.Encode(decimal.RequireFromString("1.5"), 4)
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x00, 0x00, 0xC0, 0x3F})
+
+	v, err := codec.Decode(b)
+	c.Assert(err, IsNil)
+	c.Assert(v.(decimal.Decimal).String(), Equals, "1.5")
+}
+
+func (s *CodecTestSuite) TestString(c *C) {
+	codec, _ := CodecOf(TagString)
+
+	b, err := codec.Encode("JG", 4)
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{'J', 'G', 0, 0})
+
+	v, err := codec.Decode(b)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "JG")
+
+	_, err = codec.Encode("JG-GW", 4)
+	c.Assert(err, NotNil)
+
+	_, err = codec.Encode(1, 4)
+	c.Assert(err, NotNil)
+}
+
+func (s *CodecTestSuite) TestBCD(c *C) {
+	registers, err := ParseRegisters([]byte(`[
+		{"name": "Date", "type": "action", "address": 1, "len": 3, "tag": "0x04", "format": "bcd", "max": 999999}
+	]`))
+	c.Assert(err, IsNil)
+
+	r := registers[0].(*ActionRegister)
+
+	b, err := r.Encode(map[string]any{"Date": 230815})
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x15, 0x08, 0x23})
+
+	results := make(map[string]any)
+	c.Assert(r.decode(r.codec, b, results), IsNil)
+	c.Assert(results["Date"].(Number).String(), Equals, "230815")
+
+	c.Assert(r.decode(r.codec, []byte{0x1A, 0x00, 0x00}, results), NotNil)
+}
+
+func (s *CodecTestSuite) TestBitfield(c *C) {
+	registers, err := ParseRegisters([]byte(`[
+		{"name": "Protection", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "format": "bitfield",
+		 "bits": ["OverCurrent", "", "Leakage"]}
+	]`))
+	c.Assert(err, IsNil)
+
+	r := registers[0].(*ActionRegister)
+
+	b, err := r.Encode(map[string]any{"Protection": map[string]any{"OverCurrent": true, "Leakage": true}})
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x05, 0x00})
+
+	results := make(map[string]any)
+	r.Decode([]byte{0x04, 0x00}, results)
+	c.Assert(results["Protection"], DeepEquals, map[string]bool{"OverCurrent": false, "Leakage": true})
+
+	_, err = r.Encode(map[string]any{"Protection": map[string]any{"OverCurrent": true}})
+	c.Assert(err, ErrorMatches, ".*缺少位 Leakage.*")
+}
+
+func (s *CodecTestSuite) TestInvalidType(c *C) {
+	for _, table := range []string{
+		`[{"name": "A", "type": "action", "address": 1, "len": 4, "tag": "0x2D"}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x7F"}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 4, "tag": "0x04", "coefficient": 0.1}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x21", "format": "bitfield", "bits": ["A"]}]`,
+	} {
+		_, err := ParseRegisters([]byte(table))
+		c.Assert(err, NotNil, Commentf(table))
+	}
+}
+
+// 设备回复的Tag类型与寄存器表不同时按回复解码
+func (s *CodecTestSuite) TestDecodeByResponseTag(c *C) {
+	r := action("OverCurrentTripSetting")
+
+	resp := &Frame{
+		Ctrl:     DeviceCtrl83,
+		ID:       id,
+		Function: MultiReadFun,
+		Data: []byte{0x01, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x29, 0x82, TagUint32, 0x04, 0x46, 0x00, 0x00, 0x00},
+	}
+
+	values, err := r.ParserReadResp(resp)
+	c.Assert(err, IsNil)
+	c.Assert(values["OverCurrentTripSetting"].(Number).String(), Equals, "70")
+
+	resp.Data[10] = 0x7F
+	_, err = r.ParserReadResp(resp)
+	c.Assert(err, ErrorMatches, "unsupported tag.*")
+}
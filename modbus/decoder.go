@@ -0,0 +1,70 @@
+package modbus
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+)
+
+const (
+	headerLen   = 4 // 68H L L 68H
+	minBodyLen  = 8 // 控制+终端地址+命令码
+	maxFrameLen = 255 + headerLen + 2
+)
+
+// Decoder
+// 从TCP字节流中切分出完整的帧
+// TCP不保证报文边界，一帧可能被拆成多个分段到达，多帧也可能合并在一个分段中（比如心跳后紧跟故障上报），
+// 因此按 68H L L 68H 的帧头做同步，根据长度L确定帧边界，遇到不合法的字节则逐字节跳过重新同步
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 2*maxFrameLen)}
+}
+
+// Decode 返回下一个完整的帧
+// 只有底层Reader返回错误时才会返回错误
+func (d *Decoder) Decode() (*Frame, error) {
+	for {
+		header, err := d.r.Peek(headerLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if header[0] != startFlag || header[3] != startFlag || header[1] != header[2] || header[1] < minBodyLen {
+			d.skip(1)
+			continue
+		}
+
+		l := headerLen + int(header[1]) + 2
+
+		packet, err := d.r.Peek(l)
+		if err != nil {
+			return nil, err
+		}
+
+		frame, err := NewFrame(packet)
+		if err != nil {
+			// 可能是用户数据中恰好出现了 68H L L 68H，丢弃一个字节后重新同步
+			log.Debug().Err(err).Str("packet", fmt.Sprintf("% X", packet)).Msg("resync")
+			d.skip(1)
+			continue
+		}
+
+		// Peek返回的切片在下一次读取后失效，Data需要单独保存
+		frame.Data = append([]byte(nil), frame.Data...)
+
+		log.Debug().Str("read", fmt.Sprintf("% X", packet)).Msg("")
+
+		d.skip(l)
+
+		return frame, nil
+	}
+}
+
+func (d *Decoder) skip(n int) {
+	_, _ = d.r.Discard(n)
+}
@@ -0,0 +1,77 @@
+package modbus
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder(t *testing.T) {
+	TestingT(t)
+}
+
+type DecoderTestSuite struct{}
+
+var _ = Suite(&DecoderTestSuite{})
+
+func (s *DecoderTestSuite) TestSplit(c *C) {
+	// 每次只读取一个字节，模拟一帧被拆成多个TCP分段
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(heartBeatPacket)))
+
+	f, err := d.Decode()
+	c.Assert(err, IsNil)
+	c.Assert(f.Function, Equals, HeartBeatFun)
+	c.Assert(f.Bytes(), DeepEquals, heartBeatPacket)
+
+	_, err = d.Decode()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *DecoderTestSuite) TestCoalesced(c *C) {
+	var packet []byte
+	packet = append(packet, heartBeatPacket...)
+	packet = append(packet, faultPacket...)
+
+	d := NewDecoder(bytes.NewReader(packet))
+
+	f, err := d.Decode()
+	c.Assert(err, IsNil)
+	c.Assert(f.Function, Equals, HeartBeatFun)
+
+	f, err = d.Decode()
+	c.Assert(err, IsNil)
+	c.Assert(f.Function, Equals, FaultFun)
+	c.Assert(f.Bytes(), DeepEquals, faultPacket)
+
+	_, err = d.Decode()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *DecoderTestSuite) TestResync(c *C) {
+	var packet []byte
+	packet = append(packet, 0x00, 0x16, 0x68, 0x10)
+	// 帧头合法但校验和错误的帧
+	broken := append([]byte(nil), heartBeatPacket...)
+	broken[len(broken)-2]++
+	packet = append(packet, broken...)
+	packet = append(packet, 0xFF)
+	packet = append(packet, faultPacket...)
+
+	d := NewDecoder(bytes.NewReader(packet))
+
+	f, err := d.Decode()
+	c.Assert(err, IsNil)
+	c.Assert(f.Function, Equals, FaultFun)
+
+	_, err = d.Decode()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *DecoderTestSuite) TestPartial(c *C) {
+	d := NewDecoder(bytes.NewReader(faultPacket[:20]))
+
+	_, err := d.Decode()
+	c.Assert(err, Equals, io.EOF)
+}
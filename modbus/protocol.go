@@ -22,26 +22,33 @@ type (
 		TeleindicationValue [2]byte // 遥测值
 	}
 
+	// FaultPoint
+	// 一个故障遥信点
+	FaultPoint struct {
+		Dit      [2]byte  // 遥信点号
+		Value    byte     // 遥信值
+		TimeMark TimeMark // 故障时标
+	}
+
 	// Fault
 	// 故障
 	// 4.6.2 数据头+故障数据
 	Fault struct {
-		TelemeteringNum      byte                 // 遥信个数
-		TelemeteringType     byte                 // 遥信类型
-		TelemeteringDit      [2]byte              // 遥信点号
-		TelemeteringValue    byte                 // 遥信值
-		TelemeteringTimeMark TimeMark             // 故障时标
-		TeleindicationNum    [2]byte              // 遥测个数
-		TeleindicationType   byte                 // 遥测类型
-		TeleindicationData   []TeleindicationData // 遥测数据N
+		TelemeteringNum    byte                 // 遥信个数
+		TelemeteringType   byte                 // 遥信类型
+		Telemetering       []FaultPoint         // 遥信N
+		TeleindicationNum  [2]byte              // 遥测个数
+		TeleindicationType byte                 // 遥测类型
+		TeleindicationData []TeleindicationData // 遥测数据N
 	}
 
+	// FaultAck
+	// 主站回复故障确认
+	// 4.6.3 数据头+故障遥信，原样回复终端上报的遥信
 	FaultAck struct {
-		TelemeteringNum      byte     // 遥信个数
-		TelemeteringType     byte     // 遥信类型
-		TelemeteringDit      [2]byte  // 遥信点号
-		TelemeteringValue    byte     // 遥信值
-		TelemeteringTimeMark TimeMark // 故障时标
+		TelemeteringNum  byte         // 遥信个数
+		TelemeteringType byte         // 遥信类型
+		Telemetering     []FaultPoint // 遥信N
 	}
 
 	ID [6]byte // 集中器ID（网关ID）、微端通讯地址
@@ -54,6 +61,13 @@ type (
 		ID      ID
 		NodeIDs []ID
 	}
+
+	// PowerDown
+	// 掉电
+	PowerDown struct {
+		ID      ID
+		NodeIDs []ID // 集中器上报的掉电节点，可能为空
+	}
 )
 
 // 终端、集中器控制
@@ -117,11 +131,23 @@ func NodesString(is []ID) string {
 }
 
 // Time
-// 将时标转换为可读的时间
+// 将时标转换为可读的时间，时标为CP56Time2a格式：毫秒(2) 分 时 日 月 年
+// 时标标记为无效或未填写日期时返回零值
 // 规约 4.4.1 设置时钟发送
 func (t *TimeMark) Time() time.Time {
-	sec := binary.LittleEndian.Uint16([]byte{t[0], t[1]})
-	return time.Date(int(t[6]), time.Month(t[5]), int(t[4]), int(t[3]), int(t[2]), int(sec), 0, time.Local)
+	ms := int(binary.LittleEndian.Uint16([]byte{t[0], t[1]}))
+
+	minute := int(t[2] & 0x3F)
+	hour := int(t[3] & 0x1F)
+	day := int(t[4] & 0x1F) // 高3位为星期
+	month := time.Month(t[5] & 0x0F)
+	year := 2000 + int(t[6]&0x7F)
+
+	if t[2]&0x80 != 0 || day == 0 || month == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(year, month, day, hour, minute, ms/1000, ms%1000*int(time.Millisecond), time.Local)
 }
 
 // 遥信
@@ -168,6 +194,35 @@ func (f *Frame) NewHeartBeat() (*HeartBeat, error) {
 	return h, nil
 }
 
+// NewPowerDown
+// 集中器掉电上报
+// 数据格式与心跳相同：集中器ID + 节点地址N + 数据序号
+func (f *Frame) NewPowerDown() (*PowerDown, error) {
+	if f.Ctrl != DeviceCtrl80 {
+		return nil, fmt.Errorf("frame ctrl error: ctrl expect 0x%X,got 0x%X", DeviceCtrl80, f.Ctrl)
+	}
+
+	if f.Function != PowerDownFun {
+		return nil, fmt.Errorf("frame function error: function expect 0x%X,got 0x%X", PowerDownFun, f.Function)
+	}
+
+	data := f.Data
+
+	if len(data) < 8 {
+		return nil, fmt.Errorf("frame data error: data expect len >8,got %v", len(data))
+	}
+
+	p := &PowerDown{
+		ID: [6]byte(data[:6]),
+	}
+
+	for i := 6; i+6 <= len(data)-2; i = i + 6 {
+		p.NodeIDs = append(p.NodeIDs, ID(data[i:i+6]))
+	}
+
+	return p, nil
+}
+
 // NewFault
 // 终端回复故障或上报故障
 // 规约 4.6.2
@@ -192,26 +247,35 @@ func (f *Frame) NewFault() (*Fault, error) {
 	}
 
 	fault := &Fault{
-		TelemeteringNum:      data[5],
-		TelemeteringType:     data[6],
-		TelemeteringDit:      [2]byte(data[7:9]),
-		TelemeteringValue:    data[9],
-		TelemeteringTimeMark: [7]byte(data[10:17]),
-		TeleindicationNum:    [2]byte(data[17:19]),
-		TeleindicationType:   data[19],
+		TelemeteringNum:  data[5],
+		TelemeteringType: data[6],
 	}
 
-	var teleindicationData []TeleindicationData
+	points, n, err := decodeFaultPoints(data[7:], fault.TelemeteringNum)
+	if err != nil {
+		return nil, err
+	}
+
+	fault.Telemetering = points
+
+	data = data[7+n:]
+
+	if len(data) < 3 {
+		return nil, fmt.Errorf("frame data error: teleindication expect len >= 3,got %v", len(data))
+	}
+
+	fault.TeleindicationNum = [2]byte(data[0:2])
+	fault.TeleindicationType = data[2]
+
+	num := int(binary.LittleEndian.Uint16(data[0:2]))
 
-	for i := 20; i+4 <= len(data)-1; i = i + 4 {
-		teleindicationData = append(teleindicationData, TeleindicationData{
+	for i := 3; i+4 <= len(data) && len(fault.TeleindicationData) < num; i = i + 4 {
+		fault.TeleindicationData = append(fault.TeleindicationData, TeleindicationData{
 			TeleindicationDit:   [2]byte(data[i : i+2]),
 			TeleindicationValue: [2]byte(data[i+2 : i+4]),
 		})
 	}
 
-	fault.TeleindicationData = teleindicationData
-
 	return fault, nil
 }
 
@@ -219,34 +283,91 @@ func (f *Frame) NewFault() (*Fault, error) {
 // 终端回复故障或上报故障
 // 主站回复确认
 // 规约 4.6.3
-func (f *Frame) NewFaultAck(fault *Fault) *Frame {
-	ackFrame := f.Copy()
-	f.Ctrl = ServerCtrl3
-
-	ackFrame.Data = make([]byte, 5)
-
-	ackFrame.Data[0] = FaultAckHeader[0]
-	ackFrame.Data[1] = FaultAckHeader[1]
-	ackFrame.Data[2] = FaultAckHeader[2]
-	ackFrame.Data[3] = FaultAckHeader[3]
-	ackFrame.Data[4] = FaultAckHeader[4]
-
-	ackFrame.Data = append(ackFrame.Data,
-		fault.TelemeteringNum,
-		fault.TelemeteringType,
-		fault.TelemeteringDit[0],
-		fault.TelemeteringDit[1],
-		fault.TelemeteringValue,
-		fault.TelemeteringTimeMark[0],
-		fault.TelemeteringTimeMark[1],
-		fault.TelemeteringTimeMark[2],
-		fault.TelemeteringTimeMark[3],
-		fault.TelemeteringTimeMark[4],
-		fault.TelemeteringTimeMark[5],
-		fault.TelemeteringTimeMark[6],
-	)
-
-	return ackFrame
+func NewFaultAck(address ID, fault *Fault) *Frame {
+	f := &Frame{
+		Ctrl:     ServerCtrl3,
+		ID:       address,
+		Function: FaultFun,
+	}
+
+	f.Data = make([]byte, 5)
+	f.Data[0] = FaultAckHeader[0]
+	f.Data[1] = FaultAckHeader[1]
+	f.Data[2] = FaultAckHeader[2]
+	f.Data[3] = FaultAckHeader[3]
+	f.Data[4] = FaultAckHeader[4]
+
+	f.Data = append(f.Data, byte(len(fault.Telemetering)), fault.TelemeteringType)
+
+	for _, p := range fault.Telemetering {
+		f.Data = append(f.Data, p.Dit[0], p.Dit[1], p.Value)
+		f.Data = append(f.Data, p.TimeMark[:]...)
+	}
+
+	return f
+}
+
+// ParseFaultAck
+// 解析主站回复的故障确认
+// 规约 4.6.3
+func (f *Frame) ParseFaultAck() (*FaultAck, error) {
+	if f.Ctrl != ServerCtrl3 {
+		return nil, fmt.Errorf("frame ctrl error: ctrl expect 0x%X,got 0x%X", ServerCtrl3, f.Ctrl)
+	}
+
+	if f.Function != FaultFun {
+		return nil, fmt.Errorf("frame function error: function expect 0x%X,got 0x%X", FaultFun, f.Function)
+	}
+
+	data := f.Data
+
+	if len(data) < 7 {
+		return nil, fmt.Errorf("frame data error: data expect len >= 7,got %v", len(data))
+	}
+
+	if data[0] != FaultAckHeader[0] ||
+		data[1] != FaultAckHeader[1] ||
+		data[2] != FaultAckHeader[2] ||
+		data[3] != FaultAckHeader[3] ||
+		data[4] != FaultAckHeader[4] {
+		return nil, errors.New("frame data error:  packet format error")
+	}
+
+	ack := &FaultAck{
+		TelemeteringNum:  data[5],
+		TelemeteringType: data[6],
+	}
+
+	points, _, err := decodeFaultPoints(data[7:], ack.TelemeteringNum)
+	if err != nil {
+		return nil, err
+	}
+
+	ack.Telemetering = points
+
+	return ack, nil
+}
+
+// decodeFaultPoints
+// num个 遥信点号2 + 遥信值1 + 时标7，返回读取的字节数
+func decodeFaultPoints(data []byte, num byte) ([]FaultPoint, int, error) {
+	n := int(num) * 10
+
+	if len(data) < n {
+		return nil, 0, fmt.Errorf("frame data error: %v telemetering expect len >= %v,got %v", num, n, len(data))
+	}
+
+	var points []FaultPoint
+
+	for i := 0; i < n; i = i + 10 {
+		points = append(points, FaultPoint{
+			Dit:      [2]byte(data[i : i+2]),
+			Value:    data[i+2],
+			TimeMark: [7]byte(data[i+3 : i+10]),
+		})
+	}
+
+	return points, n, nil
 }
 
 // NewTelemetering
@@ -316,11 +437,37 @@ var switchQuantities = map[int]string{
 	26: "LeakageProtection",
 }
 
+// IsTelemetering name是否为遥信点
+func IsTelemetering(name string) bool {
+	for _, n := range switchQuantities {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // NewTelemeteringAck
 // 终端回复的遥信数据
 // 规约 4.1.2
 func (f *Frame) NewTelemeteringAck(values map[string]any) error {
+	return f.telemetering(CauseActivationCon, values)
+}
+
+// NewSpontaneous
+// 终端突发上报的遥信或遥测，比如其他途径（485、本地操作）引起的变化，数据格式与回复相同，只是传送原因为突发
+func (f *Frame) NewSpontaneous(values map[string]any) error {
+	switch address := f.Key().Address; address {
+	case 0x0001:
+		return f.telemetering(CauseSpontaneous, values)
+	case 0x4001:
+		return f.teleindication(CauseSpontaneous, values)
+	default:
+		return fmt.Errorf("frame data error: unknown address 0x%X", address)
+	}
+}
 
+func (f *Frame) telemetering(cause byte, values map[string]any) error {
 	if f.Ctrl != DeviceCtrl88 {
 		return fmt.Errorf("frame ctrl error: ctrl expect 0x%X,got 0x%X", DeviceCtrl88, f.Ctrl)
 	}
@@ -331,18 +478,18 @@ func (f *Frame) NewTelemeteringAck(values map[string]any) error {
 
 	data := f.Data
 
-	if len(data) < 25 {
-		return fmt.Errorf("frame data error: data expect len >= 25,got %v", len(data))
+	// 数据头8字节+最后一个遥信点
+	n := 8
+	for index := range switchQuantities {
+		if 8+index > n {
+			n = 8 + index
+		}
+	}
+	if len(data) < n {
+		return fmt.Errorf("frame data error: data expect len >= %v,got %v", n, len(data))
 	}
 
-	if data[0] != TelemeteringAckHeader[0] ||
-		data[1] != TelemeteringAckHeader[1] ||
-		data[2] != TelemeteringAckHeader[2] ||
-		data[3] != TelemeteringAckHeader[3] ||
-		data[4] != TelemeteringAckHeader[4] ||
-		data[5] != TelemeteringAckHeader[5] ||
-		data[6] != TelemeteringAckHeader[6] ||
-		data[7] != TelemeteringAckHeader[7] {
+	if !matchHeader(data, TelemeteringAckHeader[:], cause) {
 		return errors.New("frame data error:  packet format error")
 	}
 
@@ -355,6 +502,19 @@ func (f *Frame) NewTelemeteringAck(values map[string]any) error {
 	return nil
 }
 
+// matchHeader 比较数据头，传送原因（第2个字节）与cause比较
+func matchHeader(data []byte, header []byte, cause byte) bool {
+	for i, b := range header {
+		if i == 1 {
+			b = cause
+		}
+		if data[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
 // AnalogQuantity 模拟量
 // 参数地址分配（2020）_MCB_2021.08.132
 type AnalogQuantity struct {
@@ -436,10 +596,28 @@ var analogQuantities = []*AnalogQuantity{
 	},
 }
 
+func (a *AnalogQuantity) decode(b []byte) decimal.Decimal {
+	return decimal.NewFromInt(int64(binary.LittleEndian.Uint16(b))).Mul(decimal.NewFromFloat(a.Coefficient))
+}
+
+// IsTeleindication name是否为遥测量
+func IsTeleindication(name string) bool {
+	for _, a := range analogQuantities {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // NewTeleindicationAck
 // 终端回复的遥测数据
 // 规约 4.2.2
 func (f *Frame) NewTeleindicationAck(values map[string]any) error {
+	return f.teleindication(CauseActivationCon, values)
+}
+
+func (f *Frame) teleindication(cause byte, values map[string]any) error {
 	if f.Ctrl != DeviceCtrl88 {
 		return fmt.Errorf("frame ctrl error: ctrl expect 0x%X,got 0x%X", DeviceCtrl88, f.Ctrl)
 	}
@@ -450,26 +628,57 @@ func (f *Frame) NewTeleindicationAck(values map[string]any) error {
 
 	data := f.Data
 
-	if data[0] != TeleindicationAckHeader[0] ||
-		data[1] != TeleindicationAckHeader[1] ||
-		data[2] != TeleindicationAckHeader[2] ||
-		data[3] != TeleindicationAckHeader[3] ||
-		data[4] != TeleindicationAckHeader[4] ||
-		data[5] != TeleindicationAckHeader[5] ||
-		data[6] != TeleindicationAckHeader[6] {
+	// 数据头8字节+最后一个模拟量
+	if n := 8 + analogQuantities[len(analogQuantities)-1].Num*2; len(data) < n {
+		return fmt.Errorf("frame data error: data expect len >= %v,got %v", n, len(data))
+	}
+
+	if !matchHeader(data, TeleindicationAckHeader[:], cause) {
 		return errors.New("frame data error:  packet format error")
 	}
 
 	actualData := data[8:]
 
 	for _, a := range analogQuantities {
-		values[a.Name] = decimal.NewFromInt(int64(binary.LittleEndian.Uint16(actualData[(a.Num-1)*2 : a.Num*2]))).Mul(decimal.NewFromFloat(a.Coefficient))
+		values[a.Name] = a.decode(actualData[(a.Num-1)*2 : a.Num*2])
 	}
 
 	return nil
 }
 
+// Name
+// 故障的遥信点号对应的开关量名称，与遥信的序号一致
+func (p FaultPoint) Name() string {
+	dit := int(binary.LittleEndian.Uint16(p.Dit[:]))
+	if name, ok := switchQuantities[dit]; ok {
+		return name
+	}
+	return fmt.Sprintf("Telemetering%d", dit)
+}
+
+// Analogs
+// 故障时的模拟量快照，遥测点号为 0x4000+模拟量序号，不在analogQuantities中的点号忽略
+func (f *Fault) Analogs() map[string]any {
+	values := make(map[string]any)
+
+	for _, d := range f.TeleindicationData {
+		num := int(binary.LittleEndian.Uint16(d.TeleindicationDit[:])) - 0x4000
+		for _, a := range analogQuantities {
+			if a.Num == num {
+				values[a.Name] = a.decode(d.TeleindicationValue[:])
+				break
+			}
+		}
+	}
+
+	return values
+}
+
 func NewID(s string) (ID, error) {
+	if len(s) != 12 {
+		return [6]byte{}, fmt.Errorf("地址应为12位数字：%v", s)
+	}
+
 	var bs = make([]byte, 6)
 	for index := range bs {
 		m, err := strconv.Atoi(s[index*2 : index*2+2])
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"github.com/shopspring/decimal"
 	. "gopkg.in/check.v1"
 	"testing"
 	"time"
@@ -31,10 +32,118 @@ func (s *ProtocolTestSuite) TestNewFault(c *C) {
 	}
 	c.Assert(fault.TelemeteringNum, Equals, byte(1))
 	c.Assert(fault.TeleindicationData[0].TeleindicationDit, Equals, [2]byte{0x04, 0x40})
-	c.Assert(fault.TelemeteringTimeMark.Time(), Equals, time.Date(0, 1, 1, 0, 0, 0, 0, time.Local))
+	c.Assert(fault.Telemetering, HasLen, 1)
+	c.Assert(fault.Telemetering[0].TimeMark.Time().Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)), Equals, true)
+	c.Assert(fault.TeleindicationData, HasLen, 7)
 	c.Log(fault)
 }
 
+func (s *ProtocolTestSuite) TestFaultValues(c *C) {
+	f, err := NewFrame(faultPacket)
+	if err != nil {
+		c.Fatal(err)
+	}
+	fault, err := f.NewFault()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(fault.Telemetering[0].Name(), Equals, "LeakageProtection")
+	c.Assert(fault.Telemetering[0].Value, Equals, byte(1))
+
+	analogs := fault.Analogs()
+	c.Assert(analogs["Ua"].(decimal.Decimal).String(), Equals, "222.8")
+	c.Assert(analogs["Leakage"].(decimal.Decimal).String(), Equals, "24")
+	c.Assert(analogs["T4"].(decimal.Decimal).String(), Equals, "24")
+	c.Assert(analogs, HasLen, 5)
+}
+
+func (s *ProtocolTestSuite) TestNewFaultAck(c *C) {
+	f, err := NewFrame(faultPacket)
+	if err != nil {
+		c.Fatal(err)
+	}
+	fault, err := f.NewFault()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	ackFrame := NewFaultAck(f.ID, fault)
+
+	// 故障帧的控制字不能带到回复中
+	c.Assert(ackFrame.Ctrl, Equals, ServerCtrl3)
+	c.Assert(f.Ctrl, Equals, DeviceCtrl83)
+
+	c.Assert(ackFrame.Bytes(), DeepEquals, []byte{0x68, 0x19, 0x19, 0x68, 0x03, 0x20, 0x21, 0x06, 0x17, 0x10, 0x55, 0x2A, 0x00, 0x03, 0x01, 0x00, 0x00, 0x01, 0x00, 0x1A, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x12, 0x16})
+
+	parsed, err := NewFrame(ackFrame.Bytes())
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	ack, err := parsed.ParseFaultAck()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(parsed.ID, Equals, f.ID)
+	c.Assert(ack.TelemeteringNum, Equals, fault.TelemeteringNum)
+	c.Assert(ack.TelemeteringType, Equals, fault.TelemeteringType)
+	c.Assert(ack.Telemetering, DeepEquals, fault.Telemetering)
+}
+
+func (s *ProtocolTestSuite) TestMultiPointFault(c *C) {
+	f, err := NewFrame(faultPacket)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	// 在原有的遥信后追加一个过流A相的遥信
+	data := append([]byte(nil), f.Data[:17]...)
+	data[5] = 2
+	data = append(data, 0x07, 0x00, 0x01, 0x10, 0x27, 0x05, 0x0A, 0x12, 0x08, 0x17)
+	data = append(data, f.Data[17:]...)
+
+	f = &Frame{Ctrl: DeviceCtrl83, ID: f.ID, Function: FaultFun, Data: data}
+
+	fault, err := f.NewFault()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(fault.Telemetering, HasLen, 2)
+	c.Assert(fault.Telemetering[0].Name(), Equals, "LeakageProtection")
+	c.Assert(fault.Telemetering[1].Name(), Equals, "OverCurrentProtectionA")
+	c.Assert(fault.Telemetering[1].TimeMark.Time().Equal(time.Date(2023, 8, 18, 10, 5, 10, 0, time.Local)), Equals, true)
+	c.Assert(fault.TeleindicationData, HasLen, 7)
+
+	ack, err := NewFaultAck(f.ID, fault).ParseFaultAck()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(ack.TelemeteringNum, Equals, byte(2))
+	c.Assert(ack.Telemetering, DeepEquals, fault.Telemetering)
+
+	// 遥信个数与数据长度不符
+	data[5] = 9
+	_, err = f.NewFault()
+	c.Assert(err, NotNil)
+}
+
+func (s *ProtocolTestSuite) TestTimeMark(c *C) {
+	// 12345毫秒，星期五（高3位为5），年份高位和无效位之外的保留位被忽略
+	t := TimeMark{0x39, 0x30, 0x3B, 0x17, 0xBF, 0x0C, 0x99}
+	c.Assert(t.Time().Equal(time.Date(2025, 12, 31, 23, 59, 12, 345*int(time.Millisecond), time.Local)), Equals, true)
+
+	// 无效标志
+	t[2] |= 0x80
+	c.Assert(t.Time().IsZero(), Equals, true)
+
+	// 未填写日期
+	c.Assert((&TimeMark{}).Time().IsZero(), Equals, true)
+}
+
 func (s *ProtocolTestSuite) TestNewHeartBeat(c *C) {
 
 	f, err := NewFrame(heartBeatPacket)
@@ -63,3 +172,54 @@ func (s *ProtocolTestSuite) TestNewTeleindicationAck(c *C) {
 		c.Fatal(err)
 	}
 }
+
+// spontaneous 把回复改为突发上报
+func spontaneous(c *C, packet []byte) []byte {
+	f, err := NewFrame(append([]byte(nil), packet...))
+	c.Assert(err, IsNil)
+
+	f.Data[1] = CauseSpontaneous
+	return f.Bytes()
+}
+
+func (s *ProtocolTestSuite) TestNewSpontaneous(c *C) {
+	f, err := NewFrame(spontaneous(c, teleindicationPacket))
+	c.Assert(err, IsNil)
+	c.Assert(f.Cause(), Equals, byte(CauseSpontaneous))
+
+	data := make(map[string]any)
+	c.Assert(f.NewSpontaneous(data), IsNil)
+	c.Assert(data["Ua"], NotNil)
+
+	// 突发上报不是回复，回复也不是突发上报
+	c.Assert(f.NewTeleindicationAck(make(map[string]any)), NotNil)
+
+	ack, err := NewFrame(teleindicationPacket)
+	c.Assert(err, IsNil)
+	c.Assert(ack.NewSpontaneous(make(map[string]any)), NotNil)
+}
+
+func (s *ProtocolTestSuite) TestNewPowerDown(c *C) {
+	heartBeat, err := NewFrame(heartBeatPacket)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	packet := (&Frame{Ctrl: DeviceCtrl80, Function: PowerDownFun, Data: heartBeat.Data}).Bytes()
+
+	f, err := NewFrame(packet)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	powerDown, err := f.NewPowerDown()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(powerDown.ID.String(), Equals, "111222333111")
+	c.Assert(NodesString(powerDown.NodeIDs), Equals, "072110320044")
+
+	_, err = heartBeat.NewPowerDown()
+	c.Assert(err, NotNil)
+}
@@ -9,6 +9,9 @@ type Register interface {
 
 	// Len 返回字节长度
 	Len() uint8
+
+	// Access 访问方式
+	Access() Access
 }
 
 type Readable interface {
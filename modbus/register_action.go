@@ -2,32 +2,59 @@ package modbus
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
+	"github.com/shopspring/decimal"
+	"strings"
 )
 
-// ActionRegister 动作参数寄存器 可读写
+// ActionRegister 动作参数寄存器，由寄存器表配置
 type ActionRegister struct {
 	name    string
 	address uint16
 	len     uint8
 	tag     byte
+	codec   Codec
+	bits    []string // 位域中每一位的名称，从最低位开始，为空表示不是位域
+	access  Access
+
+	// 以下只对数值类型生效
+	coefficient decimal.Decimal // 工程值 = 原始值 × 系数 + 偏移
+	offset      decimal.Decimal
+	decimals    int32 // 工程值的小数位数，小于0表示不限制
+	unit        string
+	min, max    decimal.Decimal   // 工程值的范围
+	step        decimal.Decimal   // 大于0时，工程值只能为 min + n × step
+	allowed     []decimal.Decimal // 不为空时，工程值只能为其中之一
+	constrained bool              // 寄存器表是否配置了min、max或allowed，没有配置时不允许写入
 }
 
+// maxMultiDataLen 长度L为1字节，用户数据最多 255-8 字节（控制字、终端地址、命令码共8字节）
+const maxMultiDataLen = 255 - 8
+
 func (r *ActionRegister) ReadFrame(id ID) *Frame {
+	return NewMultiReadFrame(id, []*ActionRegister{r})
+}
+
+func (r *ActionRegister) NewWriteFrame(id ID, val []byte) *Frame {
+	return NewMultiWriteFrame(id, []*ActionRegister{r}, [][]byte{val})
+}
+
+// NewMultiReadFrame 一帧读取多个参数，registers数量过多时先用 Batch 分组
+func NewMultiReadFrame(id ID, registers []*ActionRegister) *Frame {
 	data := make([]byte, 5)
 
-	data[0] = 1 // 本程序默认只支持单个参数写入
+	data[0] = byte(len(registers)) // 参数个数
 	data[1] = MultiParamsHeader[0]
 	data[2] = MultiParamsHeader[1]
 	data[3] = MultiParamsHeader[2]
 	data[4] = MultiParamsHeader[3]
 
 	data = append(data, 0x00, 0x00) // 定值区间
-	address := make([]byte, 2)
-	binary.LittleEndian.PutUint16(address, r.address)
-	data = append(data, address...) // 信息地址
+	for _, r := range registers {
+		data = binary.LittleEndian.AppendUint16(data, r.address) // 信息地址
+	}
 	return &Frame{
 		Ctrl:     ServerCtrl3,
 		ID:       id,
@@ -36,21 +63,22 @@ func (r *ActionRegister) ReadFrame(id ID) *Frame {
 	}
 }
 
-func (r *ActionRegister) NewWriteFrame(id ID, val []byte) *Frame {
+// NewMultiWriteFrame 一帧写入多个参数，values与registers一一对应
+func NewMultiWriteFrame(id ID, registers []*ActionRegister, values [][]byte) *Frame {
 	data := make([]byte, 5)
-	data[0] = 1 // 本程序默认只支持单个参数写入
+	data[0] = byte(len(registers)) // 参数个数
 	data[1] = MultiParamsHeader[0]
 	data[2] = MultiParamsHeader[1]
 	data[3] = MultiParamsHeader[2]
 	data[4] = MultiParamsHeader[3]
 	data = append(data, 0x00, 0x00) // 定值区间
 	data = append(data, 0x01)       // 特征标识
-	address := make([]byte, 2)
-	binary.LittleEndian.PutUint16(address, r.address)
-	data = append(data, address...) // 信息地址
-	data = append(data, r.tag)      // Tag类型，见扩展规约 附件1：数据类型
-	data = append(data, r.len)      // 数据长度
-	data = append(data, val...)     // 值
+	for i, r := range registers {
+		data = binary.LittleEndian.AppendUint16(data, r.address) // 信息地址
+		data = append(data, r.tag)                               // Tag类型，见扩展规约 附件1：数据类型
+		data = append(data, r.len)                               // 数据长度
+		data = append(data, values[i]...)                        // 值
+	}
 	return &Frame{
 		Ctrl:     ServerCtrl3,
 		ID:       id,
@@ -59,6 +87,33 @@ func (r *ActionRegister) NewWriteFrame(id ID, val []byte) *Frame {
 	}
 }
 
+// Batch 按帧长度限制将寄存器分组，每组可以用一帧读取或写入
+// 读回复和写请求的数据头都是8字节，每个参数占 信息地址、Tag、数据长度共4字节 加数据长度
+func Batch(registers []*ActionRegister) [][]*ActionRegister {
+	const header = 8
+
+	var batches [][]*ActionRegister
+	var current []*ActionRegister
+	n := header
+
+	for _, r := range registers {
+		size := 4 + int(r.len)
+		if len(current) > 0 && n+size > maxMultiDataLen {
+			batches = append(batches, current)
+			current = nil
+			n = header
+		}
+		current = append(current, r)
+		n += size
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
 func (r *ActionRegister) Name() string {
 	return r.name
 }
@@ -71,27 +126,207 @@ func (r *ActionRegister) Len() uint8 {
 	return r.len
 }
 
+func (r *ActionRegister) Access() Access {
+	return r.access
+}
+
+// Decode 按寄存器的Tag类型解码，数值类型返回工程值
 func (r *ActionRegister) Decode(data []byte, results map[string]any) {
-	results[r.name] = binary.LittleEndian.Uint16(data)
+	_ = r.decode(r.codec, data, results)
 }
 
+func (r *ActionRegister) decode(codec Codec, data []byte, results map[string]any) error {
+	v, err := codec.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	if len(r.bits) > 0 {
+		d, ok := v.(decimal.Decimal)
+		if !ok {
+			return fmt.Errorf("位域 %v 不是整数", r.name)
+		}
+
+		u := uint64(d.IntPart())
+		bits := make(map[string]bool)
+		for i, name := range r.bits {
+			if name != "" {
+				bits[name] = u>>i&1 == 1
+			}
+		}
+		results[r.name] = bits
+		return nil
+	}
+
+	if d, ok := v.(decimal.Decimal); ok {
+		v = Number{r.engineering(d)}
+	}
+
+	results[r.name] = v
+	return nil
+}
+
+// Encode 按寄存器的类型检查参数，数值类型的参数为工程值，检查范围后换算为原始值
 func (r *ActionRegister) Encode(params map[string]any) ([]byte, error) {
 	value, ok := params[r.name]
 	if !ok {
 		return nil, fmt.Errorf("参数 %v 缺失", r.name)
 	}
 
-	param, err := ConvertToUint16(value)
+	if len(r.bits) > 0 {
+		raw, err := r.encodeBits(value)
+		if err != nil {
+			return nil, fmt.Errorf("参数 %v：%w", r.name, err)
+		}
+		return r.codec.Encode(raw, int(r.len))
+	}
+
+	if _, ok := r.codec.(Numeric); !ok {
+		b, err := r.codec.Encode(value, int(r.len))
+		if err != nil {
+			return nil, fmt.Errorf("参数 %v：%w", r.name, err)
+		}
+		return b, nil
+	}
+
+	// 定值写错会使开关误动或拒动，原始值类型的范围不能代替设备允许的范围
+	if !r.constrained {
+		return nil, fmt.Errorf("参数 %v 未配置取值范围，不允许写入", r.name)
+	}
+
+	v, err := ToDecimal(value)
 	if err != nil {
+		return nil, fmt.Errorf("参数 %v：%w", r.name, err)
+	}
+
+	if err := r.check(v); err != nil {
 		return nil, err
 	}
 
-	dst := make([]byte, 2)
-	binary.LittleEndian.PutUint16(dst, param)
-	return dst, nil
+	if r.decimals >= 0 && !v.Equal(v.Round(r.decimals)) {
+		return nil, fmt.Errorf("参数 %v 最多 %v 位小数：%v%v", r.name, r.decimals, v, r.unit)
+	}
+
+	raw := v.Sub(r.offset).Div(r.coefficient)
+	if r.codec.(Numeric).Integer() && !raw.IsInteger() {
+		return nil, fmt.Errorf("参数 %v 的分辨率为 %v%v，无法精确表示：%v%v", r.name, r.coefficient, r.unit, v, r.unit)
+	}
+
+	b, err := r.codec.Encode(raw, int(r.len))
+	if err != nil {
+		return nil, fmt.Errorf("参数 %v：%w", r.name, err)
+	}
+	return b, nil
+}
+
+// check 检查工程值是否满足范围、步长和可选值的约束，错误信息中给出允许的取值
+func (r *ActionRegister) check(v decimal.Decimal) error {
+	if len(r.allowed) > 0 {
+		for _, a := range r.allowed {
+			if v.Equal(a) {
+				return nil
+			}
+		}
+
+		var values []string
+		for _, a := range r.allowed {
+			values = append(values, a.String()+r.unit)
+		}
+		return fmt.Errorf("参数 %v 只能为 %v：%v%v", r.name, strings.Join(values, "、"), v, r.unit)
+	}
+
+	if v.LessThan(r.min) || v.GreaterThan(r.max) {
+		return fmt.Errorf("参数 %v 超出范围 %v%v ~ %v%v：%v%v", r.name, r.min, r.unit, r.max, r.unit, v, r.unit)
+	}
+
+	if r.step.IsPositive() && !v.Sub(r.min).Mod(r.step).IsZero() {
+		return fmt.Errorf("参数 %v 应为 %v%v ~ %v%v 之间步长 %v%v 的值：%v%v", r.name, r.min, r.unit, r.max, r.unit, r.step, r.unit, v, r.unit)
+	}
+
+	return nil
+}
+
+// engineering 原始值换算为工程值
+func (r *ActionRegister) engineering(raw decimal.Decimal) decimal.Decimal {
+	v := raw.Mul(r.coefficient).Add(r.offset)
+	if r.decimals >= 0 {
+		v = v.Round(r.decimals)
+	}
+	return v
+}
+
+// Number
+// 参数的工程值，JSON中为数字，与之前读取参数时返回的数字保持一致
+// 遥测值仍为decimal.Decimal，JSON中为字符串
+type Number struct {
+	decimal.Decimal
+}
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+// Unit 工程值的单位，没有单位时为空
+func (r *ActionRegister) Unit() string {
+	return r.unit
+}
+
+// encodeBits 位域的参数为 {"位名称": true}，需要给出所有位
+func (r *ActionRegister) encodeBits(value any) (decimal.Decimal, error) {
+	bits, ok := value.(map[string]any)
+	if !ok {
+		return decimal.Zero, fmt.Errorf("期望对象，实际：%T", value)
+	}
+
+	var u int64
+	for i, name := range r.bits {
+		if name == "" {
+			continue
+		}
+
+		v, ok := bits[name]
+		if !ok {
+			return decimal.Zero, fmt.Errorf("缺少位 %v", name)
+		}
+
+		b, ok := v.(bool)
+		if !ok {
+			return decimal.Zero, fmt.Errorf("位 %v 期望布尔值，实际：%T", name, v)
+		}
+
+		if b {
+			u |= 1 << i
+		}
+	}
+
+	for name := range bits {
+		if !r.hasBit(name) {
+			return decimal.Zero, fmt.Errorf("未知的位 %v", name)
+		}
+	}
+
+	return decimal.NewFromInt(u), nil
+}
+
+func (r *ActionRegister) hasBit(name string) bool {
+	for _, n := range r.bits {
+		if n != "" && n == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *ActionRegister) ParserWriteResp(frame *Frame) (bool, error) {
+	return ParseMultiWriteResp(frame)
+}
+
+func (r *ActionRegister) ParserReadResp(frame *Frame) (map[string]any, error) {
+	return ParseMultiReadResp(frame, []*ActionRegister{r})
+}
+
+// ParseMultiWriteResp 写多个参数的回复，设备对整帧给出一个结果
+func ParseMultiWriteResp(frame *Frame) (bool, error) {
 	if frame.Ctrl != DeviceCtrl80 {
 		return false, fmt.Errorf("expect ctrl 0x%X, got 0x%X", DeviceCtrl80, frame.Ctrl)
 	}
@@ -123,7 +358,8 @@ func (r *ActionRegister) ParserWriteResp(frame *Frame) (bool, error) {
 	return false, nil
 }
 
-func (r *ActionRegister) ParserReadResp(frame *Frame) (map[string]any, error) {
+// ParseMultiReadResp 读多个参数的回复，按信息地址找到对应的寄存器解析
+func ParseMultiReadResp(frame *Frame, registers []*ActionRegister) (map[string]any, error) {
 	if frame.Ctrl != DeviceCtrl83 {
 		return nil, fmt.Errorf("expect ctrl 0x%X, got 0x%X", DeviceCtrl83, frame.Ctrl)
 	}
@@ -134,18 +370,15 @@ func (r *ActionRegister) ParserReadResp(frame *Frame) (map[string]any, error) {
 
 	data := frame.Data
 
-	l := len(data)
-
-	if l == 5 {
+	if len(data) == 5 {
 		return nil, fmt.Errorf("错误的信息地址或组号")
 	}
 
 	if len(data) < 12 {
-		return nil, fmt.Errorf("frame error: packet lenght expect >= 6, got %v", len(data))
+		return nil, fmt.Errorf("frame error: packet lenght expect >= 12, got %v", len(data))
 	}
 
-	if data[0] != 0x01 ||
-		data[1] != MultiReadAckHeader[0] ||
+	if data[1] != MultiReadAckHeader[0] ||
 		data[2] != MultiReadAckHeader[1] ||
 		data[3] != MultiReadAckHeader[2] ||
 		data[4] != MultiReadAckHeader[3] ||
@@ -156,44 +389,90 @@ func (r *ActionRegister) ParserReadResp(frame *Frame) (map[string]any, error) {
 		return nil, errors.New("invalid telecontrol ack header")
 	}
 
-	address := binary.LittleEndian.Uint16(data[8:10])
-	if address != r.address {
-		return nil, fmt.Errorf("expect address 0x%X, got 0x%X", r.address, address)
+	if int(data[0]) != len(registers) {
+		return nil, fmt.Errorf("expect %v params, got %v", len(registers), data[0])
 	}
 
-	// Tag类型，见扩展规约 附件1：数据类型
-	tag := data[10]
-	if tag != r.tag {
-		return nil, fmt.Errorf("expect tag 0x%X, got 0x%X", r.tag, tag)
-	}
+	result := make(map[string]any)
 
-	dataLen := data[11]
-	if dataLen != r.len {
-		return nil, fmt.Errorf("expect len 0x%X, got 0x%X", r.len, dataLen)
-	}
+	data = data[8:]
+	for range registers {
+		if len(data) < 4 {
+			return nil, errors.New("frame error: packet too short")
+		}
 
-	result := make(map[string]any)
+		address := binary.LittleEndian.Uint16(data[0:2])
+
+		var r *ActionRegister
+		for _, register := range registers {
+			if register.address == address {
+				r = register
+				break
+			}
+		}
+		if r == nil {
+			return nil, fmt.Errorf("unexpected address 0x%X", address)
+		}
+
+		// 按设备实际回复的Tag类型解码，见扩展规约 附件1：数据类型
+		tag := data[2]
+		codec, err := r.codecOf(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		dataLen := data[3]
+		if size := codec.Size(); size != 0 && size != int(dataLen) {
+			return nil, fmt.Errorf("tag 0x%X expect len %v, got %v", tag, size, dataLen)
+		}
 
-	r.Decode(data[12:12+l], result)
+		if len(data) < 4+int(dataLen) {
+			return nil, errors.New("frame error: packet too short")
+		}
+
+		if err := r.decode(codec, data[4:4+int(dataLen)], result); err != nil {
+			return nil, fmt.Errorf("%v：%w", r.name, err)
+		}
+
+		data = data[4+int(dataLen):]
+	}
 
 	return result, nil
 }
 
-func ConvertToUint16(val interface{}) (uint16, error) {
+// codecOf 回复的Tag类型与寄存器一致时使用寄存器的Codec（可能由format指定），否则使用Tag类型的默认Codec
+func (r *ActionRegister) codecOf(tag byte) (Codec, error) {
+	if tag == r.tag {
+		return r.codec, nil
+	}
+
+	codec, ok := CodecOf(tag)
+	if !ok {
+		return nil, fmt.Errorf("unsupported tag 0x%X", tag)
+	}
+	return codec, nil
+}
+
+// ToDecimal 将JSON中的参数转换为decimal，数字或数字字符串
+func ToDecimal(val interface{}) (decimal.Decimal, error) {
 	switch v := val.(type) {
-	case uint16:
+	case decimal.Decimal:
 		return v, nil
+	case Number:
+		return v.Decimal, nil
 	case int:
-		if v < 0 || v > math.MaxUint16 {
-			return 0, fmt.Errorf("value out of range for uint16: %v", v)
-		}
-		return uint16(v), nil
+		return decimal.NewFromInt(int64(v)), nil
+	case int64:
+		return decimal.NewFromInt(v), nil
+	case uint16:
+		return decimal.NewFromInt(int64(v)), nil
 	case float64:
-		if v < 0 || v > math.MaxUint16 {
-			return 0, fmt.Errorf("value out of range for uint16: %v", v)
-		}
-		return uint16(v), nil
+		return decimal.NewFromFloat(v), nil
+	case json.Number:
+		return decimal.NewFromString(v.String())
+	case string:
+		return decimal.NewFromString(v)
 	default:
-		return 0, fmt.Errorf("unsupported type %T for uint16 conversion", val)
+		return decimal.Zero, fmt.Errorf("unsupported type %T for decimal conversion", val)
 	}
 }
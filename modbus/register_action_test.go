@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"encoding/json"
 	. "gopkg.in/check.v1"
 	"testing"
 )
@@ -15,12 +16,71 @@ var _ = Suite(&ActionRegisterTestSuite{})
 
 var id ID = [6]byte{0x07, 0x21, 0x07, 0x63, 0x02, 0x89}
 
+func action(name string) *ActionRegister {
+	return FindRegister(name).(*ActionRegister)
+}
+
 func (s *ActionRegisterTestSuite) TestWriteFrame(c *C) {
-	writeFrame := UnderVoltageTripSetting.NewWriteFrame(id, []byte{0xA5, 0x00})
+	writeFrame := action("UnderVoltageTripSetting").NewWriteFrame(id, []byte{0xA5, 0x00})
 	c.Assert(writeFrame.Data, DeepEquals, []byte{0x01, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x82, 0x2D, 0x02, 0xA5, 0x00})
 }
 
 func (s *ActionRegisterTestSuite) TestReadFrame(c *C) {
-	writeFrame := UnderVoltageTripSetting.ReadFrame(id)
+	writeFrame := action("UnderVoltageTripSetting").ReadFrame(id)
 	c.Assert(writeFrame.Data, DeepEquals, []byte{0x01, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x42, 0x82})
 }
+
+func (s *ActionRegisterTestSuite) TestMultiRead(c *C) {
+	registers := []*ActionRegister{action("OverCurrentTripSetting"), action("UnderVoltageTripSetting")}
+
+	read := NewMultiReadFrame(id, registers)
+	c.Assert(read.Data, DeepEquals, []byte{0x02, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x29, 0x82, 0x42, 0x82})
+
+	resp := &Frame{
+		Ctrl:     DeviceCtrl83,
+		ID:       id,
+		Function: MultiReadFun,
+		Data: []byte{0x02, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x42, 0x82, 0x2D, 0x02, 0xA5, 0x00,
+			0x29, 0x82, 0x2D, 0x02, 0x46, 0x00},
+	}
+
+	values, err := ParseMultiReadResp(resp, registers)
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, 2)
+	c.Assert(values["OverCurrentTripSetting"].(Number).String(), Equals, "70")
+	c.Assert(values["UnderVoltageTripSetting"].(Number).String(), Equals, "165")
+
+	// 参数在JSON中为数字
+	b, err := json.Marshal(values)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `{"OverCurrentTripSetting":70,"UnderVoltageTripSetting":165}`)
+
+	// 回复的参数个数不符
+	_, err = ParseMultiReadResp(resp, registers[:1])
+	c.Assert(err, NotNil)
+}
+
+func (s *ActionRegisterTestSuite) TestMultiWrite(c *C) {
+	registers := []*ActionRegister{action("OverCurrentTripSetting"), action("UnderVoltageTripSetting")}
+
+	write := NewMultiWriteFrame(id, registers, [][]byte{{0x46, 0x00}, {0xA5, 0x00}})
+	c.Assert(write.Data, DeepEquals, []byte{0x02, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x29, 0x82, 0x2D, 0x02, 0x46, 0x00,
+		0x42, 0x82, 0x2D, 0x02, 0xA5, 0x00})
+}
+
+func (s *ActionRegisterTestSuite) TestBatch(c *C) {
+	var registers []*ActionRegister
+	for i := 0; i < 100; i++ {
+		registers = append(registers, action("OverCurrentTripSetting"))
+	}
+
+	batches := Batch(registers)
+	c.Assert(batches, HasLen, 3)
+	c.Assert(batches[0], HasLen, 39)
+
+	for _, batch := range batches {
+		c.Assert(len(NewMultiWriteFrame(id, batch, make([][]byte, len(batch))).Data) <= maxMultiDataLen, Equals, true)
+	}
+}
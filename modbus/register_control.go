@@ -44,6 +44,10 @@ func (r *ControlRegister) Len() uint8 {
 	return 1
 }
 
+func (r *ControlRegister) Access() Access {
+	return AccessWriteOnly
+}
+
 func (r *ControlRegister) Encode(params map[string]any) ([]byte, error) {
 	value, ok := params[r.name]
 	if !ok {
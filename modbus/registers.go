@@ -1,62 +1,306 @@
 package modbus
 
-var (
-	AllRegister = []Register{&Switch, &OverCurrentTripSetting, &OverLoadTripSetting, &OverTemperatureTripSetting, &OverTemperatureTripSetting, &OverVoltageTripSetting, &UnderVoltageTripSetting, &LeakageTripSetting}
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultRegisters 内置的寄存器表，可以用 LoadRegisterFile 替换
+//
+//go:embed registers.json
+var defaultRegisters []byte
+
+// AllRegister 当前使用的寄存器表
+var AllRegister []Register
 
-	// Switch 开关
-	Switch = ControlRegister{
-		name:    "Switch",
-		address: 0x6001,
+func init() {
+	registers, err := ParseRegisters(defaultRegisters)
+	if err != nil {
+		panic(fmt.Errorf("内置寄存器表错误：%w", err))
 	}
+	AllRegister = registers
+}
+
+// 寄存器类型
+const (
+	registerAction  = "action"  // 参数、定值，通过 MultiReadFun/MultiWriteFun 读写
+	registerControl = "control" // 遥控，通过 Telecontrol 写入
+)
 
-	// OverCurrentTripSetting 过流跳闸定值
-	OverCurrentTripSetting = ActionRegister{
-		name:    "OverCurrentTripSetting",
-		address: 0x8229,
-		len:     2,
-		tag:     0x2D,
+// Access 访问方式
+type Access string
+
+const (
+	AccessReadWrite Access = "rw"
+	AccessReadOnly  Access = "ro"
+	AccessWriteOnly Access = "wo"
+)
+
+func (a Access) CanRead() bool {
+	return a == AccessReadWrite || a == AccessReadOnly
+}
+
+func (a Access) CanWrite() bool {
+	return a == AccessReadWrite || a == AccessWriteOnly
+}
+
+// registerConfig 寄存器表中的一项
+//
+//	{"name": "UnderVoltageTripSetting", "type": "action", "address": "0x8242", "len": 2, "tag": "0x2D",
+//	 "access": "rw", "coefficient": 0.1, "decimals": 1, "unit": "V", "min": 150, "max": 200, "step": 0.5}
+type registerConfig struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Address     hexNumber         `json:"address"`
+	Len         uint8             `json:"len"`
+	Tag         hexNumber         `json:"tag"`    // 见扩展规约 附件1：数据类型
+	Format      string            `json:"format"` // 覆盖Tag类型的默认解释：bcd、bytes、bitfield
+	Bits        []string          `json:"bits"`   // 位域中每一位的名称，从最低位开始，空字符串表示未使用的位
+	Access      Access            `json:"access"`
+	Coefficient *decimal.Decimal  `json:"coefficient"` // 工程值 = 原始值 × 系数 + 偏移，系数默认为1
+	Offset      *decimal.Decimal  `json:"offset"`
+	Decimals    *int32            `json:"decimals"` // 工程值的小数位数，默认不限制
+	Unit        string            `json:"unit"`
+	Min         *decimal.Decimal  `json:"min"` // 工程值的范围，默认为原始值类型的范围；min、max、allowed都没有配置时不允许写入
+	Max         *decimal.Decimal  `json:"max"`
+	Step        *decimal.Decimal  `json:"step"`    // 工程值只能为 min + n × step
+	Allowed     []decimal.Decimal `json:"allowed"` // 工程值只能为其中之一，指定后不再检查范围和步长
+	Comment     string            `json:"comment"`
+}
+
+// hexNumber 可以写成数字，也可以写成 "0x8229" 的形式
+type hexNumber uint64
+
+func (h *hexNumber) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return err
 	}
 
-	// OverLoadTripSetting 过载跳闸定值
-	OverLoadTripSetting = ActionRegister{
-		name:    "OverLoadTripSetting",
-		address: 0x8230,
-		len:     2,
-		tag:     0x2D,
+	*h = hexNumber(v)
+	return nil
+}
+
+// LoadRegisterFile 从文件加载寄存器表，检查通过后替换当前的寄存器表，应在启动时调用
+func LoadRegisterFile(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
 
-	// LeakageTripSetting 漏电跳闸定值
-	LeakageTripSetting = ActionRegister{
-		name:    "LeakageTripSetting",
-		address: 0x8236,
-		len:     2,
-		tag:     0x2D,
+	registers, err := ParseRegisters(buf)
+	if err != nil {
+		return fmt.Errorf("寄存器表 %v 错误：%w", path, err)
 	}
 
-	// OverVoltageTripSetting 过压跳闸定值 0x823CH
-	OverVoltageTripSetting = ActionRegister{
-		name:    "OverVoltageTripSetting",
-		address: 0x8236,
-		len:     2,
-		tag:     0x2D,
+	AllRegister = registers
+	return nil
+}
+
+// ParseRegisters 解析并检查寄存器表，名称和地址都不能重复
+func ParseRegisters(buf []byte) ([]Register, error) {
+	var configs []registerConfig
+	if err := json.Unmarshal(buf, &configs); err != nil {
+		return nil, err
 	}
 
-	// UnderVoltageTripSetting 欠压跳闸定值
-	UnderVoltageTripSetting = ActionRegister{
-		name:    "UnderVoltageTripSetting",
-		address: 0x8242,
-		len:     2,
-		tag:     0x2D,
+	var registers []Register
+
+	names := make(map[string]bool)
+	addresses := make(map[uint16]string)
+
+	for i, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("第%d项缺少名称", i+1)
+		}
+
+		if names[c.Name] {
+			return nil, fmt.Errorf("名称 %v 重复", c.Name)
+		}
+		names[c.Name] = true
+
+		address := uint16(c.Address)
+		if name, ok := addresses[address]; ok {
+			return nil, fmt.Errorf("%v 与 %v 的地址 0x%X 重复", c.Name, name, address)
+		}
+		addresses[address] = c.Name
+
+		r, err := c.register()
+		if err != nil {
+			return nil, fmt.Errorf("%v：%w", c.Name, err)
+		}
+
+		registers = append(registers, r)
+	}
+
+	return registers, nil
+}
+
+func (c *registerConfig) register() (Register, error) {
+	switch c.Type {
+	case registerAction:
+		return c.actionRegister()
+	case registerControl:
+		if c.Access != "" && c.Access != AccessWriteOnly {
+			return nil, errors.New("遥控只能写入")
+		}
+		return &ControlRegister{
+			name:    c.Name,
+			address: uint16(c.Address),
+		}, nil
+	default:
+		return nil, fmt.Errorf("未知的类型 %q", c.Type)
 	}
+}
 
-	// OverTemperatureTripSetting 过温跳闸定值
-	OverTemperatureTripSetting = ActionRegister{
-		name:    "OverTemperatureTripSetting",
-		address: 0x824E,
-		len:     2,
-		tag:     0x2D,
+func (c *registerConfig) actionRegister() (*ActionRegister, error) {
+	if c.Tag == 0 || c.Tag > 0xFF {
+		return nil, fmt.Errorf("Tag类型 0x%X 错误", c.Tag)
 	}
-)
+
+	codec, err := c.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Len == 0 {
+		return nil, errors.New("缺少数据长度")
+	}
+
+	if size := codec.Size(); size != 0 && size != int(c.Len) {
+		return nil, fmt.Errorf("Tag类型 0x%X 的数据长度应为 %v", c.Tag, size)
+	}
+
+	if c.Format == "bcd" && c.Len > 8 {
+		return nil, errors.New("BCD码最多8字节")
+	}
+
+	access := c.Access
+	if access == "" {
+		access = AccessReadWrite
+	}
+	if !access.CanRead() && !access.CanWrite() {
+		return nil, fmt.Errorf("未知的访问方式 %q", c.Access)
+	}
+
+	r := &ActionRegister{
+		name:    c.Name,
+		address: uint16(c.Address),
+		len:     c.Len,
+		tag:     byte(c.Tag),
+		codec:   codec,
+		bits:    c.Bits,
+		access:  access,
+	}
+
+	numeric, ok := codec.(Numeric)
+	if !ok || len(c.Bits) > 0 {
+		if c.Coefficient != nil || c.Offset != nil || c.Decimals != nil || c.Unit != "" ||
+			c.Min != nil || c.Max != nil || c.Step != nil || len(c.Allowed) > 0 {
+			return nil, errors.New("系数、偏移、小数位数、单位和取值约束只适用于数值类型")
+		}
+		return r, nil
+	}
+
+	r.coefficient = decimal.NewFromInt(1)
+	if c.Coefficient != nil {
+		if !c.Coefficient.IsPositive() {
+			return nil, errors.New("系数必须大于0")
+		}
+		r.coefficient = *c.Coefficient
+	}
+
+	if c.Offset != nil {
+		r.offset = *c.Offset
+	}
+
+	r.decimals = -1
+	if c.Decimals != nil {
+		if *c.Decimals < 0 {
+			return nil, errors.New("小数位数不能小于0")
+		}
+		r.decimals = *c.Decimals
+	}
+
+	r.unit = c.Unit
+
+	// 默认为原始值类型的范围
+	min, max := numeric.Range()
+	r.min = min.Mul(r.coefficient).Add(r.offset)
+	r.max = max.Mul(r.coefficient).Add(r.offset)
+
+	if c.Min != nil {
+		r.min = *c.Min
+	}
+	if c.Max != nil {
+		r.max = *c.Max
+	}
+
+	if r.min.GreaterThan(r.max) {
+		return nil, fmt.Errorf("最小值 %v 大于最大值 %v", r.min, r.max)
+	}
+
+	if c.Step != nil {
+		if !c.Step.IsPositive() {
+			return nil, errors.New("步长必须大于0")
+		}
+		r.step = *c.Step
+	}
+
+	// 可选值也必须能用原始值表示
+	for _, a := range c.Allowed {
+		if a.LessThan(r.min) || a.GreaterThan(r.max) {
+			return nil, fmt.Errorf("可选值 %v 超出范围 %v ~ %v", a, r.min, r.max)
+		}
+	}
+	r.allowed = c.Allowed
+
+	r.constrained = c.Min != nil || c.Max != nil || len(c.Allowed) > 0
+
+	return r, nil
+}
+
+// codec 寄存器的Codec，format优先于Tag类型
+func (c *registerConfig) codec() (Codec, error) {
+	tagCodec, ok := CodecOf(byte(c.Tag))
+
+	switch c.Format {
+	case "":
+		if !ok {
+			return nil, fmt.Errorf("不支持的Tag类型 0x%X", c.Tag)
+		}
+		if len(c.Bits) > 0 {
+			return nil, errors.New("位域需要指定 format 为 bitfield")
+		}
+		return tagCodec, nil
+	case "bitfield":
+		ic, ok := tagCodec.(intCodec)
+		if !ok || ic.signed {
+			return nil, fmt.Errorf("位域的Tag类型 0x%X 应为无符号整数", c.Tag)
+		}
+		if len(c.Bits) == 0 || len(c.Bits) > ic.size*8 {
+			return nil, fmt.Errorf("位域应有 1 ~ %v 位", ic.size*8)
+		}
+		return tagCodec, nil
+	default:
+		codec, ok := formats[c.Format]
+		if !ok {
+			return nil, fmt.Errorf("未知的format %q", c.Format)
+		}
+		if len(c.Bits) > 0 {
+			return nil, errors.New("位域需要指定 format 为 bitfield")
+		}
+		return codec, nil
+	}
+}
 
 func FindRegister(name string) Register {
 	for _, r := range AllRegister {
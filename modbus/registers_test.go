@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type RegistersTestSuite struct{}
+
+var _ = Suite(&RegistersTestSuite{})
+
+func (s *RegistersTestSuite) TestDefault(c *C) {
+	c.Assert(AllRegister, HasLen, 7)
+	c.Assert(FindRegister("OverVoltageTripSetting").Address(), Equals, uint16(0x823C))
+	c.Assert(FindRegister("Switch").Access(), Equals, AccessWriteOnly)
+}
+
+func (s *RegistersTestSuite) TestDuplicate(c *C) {
+	_, err := ParseRegisters([]byte(`[
+		{"name": "A", "type": "action", "address": "0x8229", "len": 2, "tag": "0x2D"},
+		{"name": "A", "type": "action", "address": "0x8230", "len": 2, "tag": "0x2D"}
+	]`))
+	c.Assert(err, ErrorMatches, ".*名称 A 重复.*")
+
+	_, err = ParseRegisters([]byte(`[
+		{"name": "A", "type": "action", "address": "0x8236", "len": 2, "tag": "0x2D"},
+		{"name": "B", "type": "action", "address": "0x8236", "len": 2, "tag": "0x2D"}
+	]`))
+	c.Assert(err, ErrorMatches, ".*地址 0x8236 重复.*")
+}
+
+func (s *RegistersTestSuite) TestInvalid(c *C) {
+	for _, table := range []string{
+		`[{"name": "A", "type": "unknown", "address": 1}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "access": "x"}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "min": 10, "max": 1}]`,
+		`[{"name": "A", "type": "control", "address": 1, "access": "rw"}]`,
+	} {
+		_, err := ParseRegisters([]byte(table))
+		c.Assert(err, NotNil, Commentf(table))
+	}
+}
+
+func (s *RegistersTestSuite) TestEncode(c *C) {
+	registers, err := ParseRegisters([]byte(`[
+		{"name": "Voltage", "type": "action", "address": "0x8242", "len": 2, "tag": "0x2D", "coefficient": 0.1, "min": 150, "max": 200}
+	]`))
+	c.Assert(err, IsNil)
+
+	r := registers[0].(*ActionRegister)
+
+	b, err := r.Encode(map[string]any{"Voltage": 165.5})
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x77, 0x06})
+
+	results := make(map[string]any)
+	r.Decode(b, results)
+	c.Assert(results["Voltage"], FitsTypeOf, Number{})
+	c.Assert(results["Voltage"].(interface{ String() string }).String(), Equals, "165.5")
+
+	_, err = r.Encode(map[string]any{"Voltage": 250})
+	c.Assert(err, ErrorMatches, ".*超出范围.*")
+
+	_, err = r.Encode(map[string]any{"Voltage": 165.55})
+	c.Assert(err, ErrorMatches, ".*分辨率.*")
+}
+
+func (s *RegistersTestSuite) TestScaling(c *C) {
+	registers, err := ParseRegisters([]byte(`[
+		{"name": "Temperature", "type": "action", "address": 1, "len": 2, "tag": "0x21",
+		 "coefficient": 0.1, "offset": -40, "decimals": 1, "unit": "℃", "max": 125}
+	]`))
+	c.Assert(err, IsNil)
+
+	r := registers[0].(*ActionRegister)
+	c.Assert(r.Unit(), Equals, "℃")
+	c.Assert(r.min.String(), Equals, "-3316.8")
+
+	// 原始值 = (25.5 + 40) / 0.1 = 655
+	b, err := r.Encode(map[string]any{"Temperature": "25.5"})
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x8F, 0x02})
+
+	results := make(map[string]any)
+	r.Decode(b, results)
+	c.Assert(results["Temperature"].(Number).String(), Equals, "25.5")
+
+	_, err = r.Encode(map[string]any{"Temperature": 25.55})
+	c.Assert(err, ErrorMatches, "参数 Temperature 最多 1 位小数：25.55℃")
+
+	_, err = r.Encode(map[string]any{"Temperature": 4000})
+	c.Assert(err, ErrorMatches, "参数 Temperature 超出范围 -3316.8℃ ~ 125℃：4000℃")
+}
+
+func (s *RegistersTestSuite) TestConstraints(c *C) {
+	registers, err := ParseRegisters([]byte(`[
+		{"name": "Leakage", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "unit": "mA", "allowed": [30, 50, 100]},
+		{"name": "Voltage", "type": "action", "address": 2, "len": 2, "tag": "0x2D", "unit": "V", "min": 150, "max": 200, "step": 5}
+	]`))
+	c.Assert(err, IsNil)
+
+	leakage := registers[0].(*ActionRegister)
+	voltage := registers[1].(*ActionRegister)
+
+	_, err = leakage.Encode(map[string]any{"Leakage": 50})
+	c.Assert(err, IsNil)
+
+	_, err = leakage.Encode(map[string]any{"Leakage": 40})
+	c.Assert(err, ErrorMatches, "参数 Leakage 只能为 30mA、50mA、100mA：40mA")
+
+	_, err = voltage.Encode(map[string]any{"Voltage": 165})
+	c.Assert(err, IsNil)
+
+	_, err = voltage.Encode(map[string]any{"Voltage": 163})
+	c.Assert(err, ErrorMatches, "参数 Voltage 应为 150V ~ 200V 之间步长 5V 的值：163V")
+
+	// 默认寄存器表没有取值范围，定值都不允许写入
+	for _, name := range []string{"LeakageTripSetting", "UnderVoltageTripSetting"} {
+		r := FindRegister(name).(*ActionRegister)
+		for _, v := range []int{0, 100, 65535} {
+			_, err = r.Encode(map[string]any{name: v})
+			c.Assert(err, ErrorMatches, "参数 "+name+" 未配置取值范围，不允许写入")
+		}
+	}
+
+	for _, table := range []string{
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "step": 0}]`,
+		`[{"name": "A", "type": "action", "address": 1, "len": 2, "tag": "0x2D", "max": 100, "allowed": [50, 150]}]`,
+	} {
+		_, err := ParseRegisters([]byte(table))
+		c.Assert(err, NotNil, Commentf(table))
+	}
+}
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
@@ -9,49 +10,218 @@ import (
 	"time"
 )
 
+const unsolicitedSize = 32 // 缓存的主动上报帧数量
+
+var (
+	ErrClosed       = errors.New("modbus: connection closed")
+	ErrServerClosed = errors.New("modbus: server closed")
+)
+
 type (
 	Conn struct {
-		rwc    net.Conn
-		server *Server
-		mu     sync.Mutex
+		rwc     net.Conn
+		server  *Server
+		decoder *Decoder
+
+		wmu sync.Mutex // 保证帧完整写出
+
+		mu      sync.Mutex
+		pending []*call // 等待回复的请求，按发送顺序
+
+		unsolicited chan *Frame // 心跳、注册、故障等非请求回复的帧
+		done        chan struct{}
+		err         error // 读取协程退出的原因，done关闭后可读
+
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		connectedAt time.Time
 	}
 
 	Server struct {
 		address string
-		serve   func(conn *Conn)
+		serve   func(ctx context.Context, conn *Conn)
+
+		// ctx 传给serve，Shutdown时取消
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		mu         sync.Mutex
+		listener   net.Listener
+		conns      map[*Conn]struct{}
+		inShutdown bool
+		serving    sync.WaitGroup // 正在运行的serve
+		inflight   sync.WaitGroup // 正在等待回复的请求
 	}
 )
 
-func (c *Conn) Read(size int, timeout time.Duration) (*Frame, error) {
-	c.rwc.SetReadDeadline(time.Now().Add(timeout))
+func newConn(rwc net.Conn, server *Server) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		ctx:         ctx,
+		cancel:      cancel,
+		rwc:         rwc,
+		server:      server,
+		decoder:     NewDecoder(rwc),
+		unsolicited: make(chan *Frame, unsolicitedSize),
+		done:        make(chan struct{}),
+		connectedAt: time.Now(),
+	}
+	go c.readLoop()
+	return c
+}
 
-	defer c.rwc.SetReadDeadline(time.Time{})
+// readLoop
+// 每个连接只有一个读取协程，读到的帧优先交给等待回复的请求，其余的放入unsolicited
+func (c *Conn) readLoop() {
+	for {
+		f, err := c.decoder.Decode()
+		if err != nil {
+			c.err = err
+			close(c.done)
+			c.cancel()
+			return
+		}
 
-	buf := make([]byte, size)
+		if c.dispatch(f) {
+			continue
+		}
 
-	l, err := c.rwc.Read(buf)
-	if err != nil {
-		return nil, err
+		select {
+		case c.unsolicited <- f:
+		default:
+			log.Warn().Str("remote", c.Addr().String()).Str("Function", fmt.Sprintf("0x%X", f.Function)).Msg("主动上报帧积压，丢弃")
+		}
 	}
+}
 
-	log.Debug().Str("read", fmt.Sprintf("% X", buf[:l])).Msg("")
+func (c *Conn) dispatch(f *Frame) bool {
+	if !f.Reply() {
+		return false
+	}
 
-	return NewFrame(buf[:l])
+	key := f.Key()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, cl := range c.pending {
+		if cl.key.Match(key) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			cl.resp <- f
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Conn) Write(frame *Frame, timeout time.Duration) error {
+func (c *Conn) remove(cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	for i := range c.pending {
+		if c.pending[i] == cl {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReadFrame 读取下一个终端主动上报的帧
+func (c *Conn) ReadFrame(ctx context.Context) (*Frame, error) {
+	select {
+	case f := <-c.unsolicited:
+		return f, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WriteFrame 写出一帧，ctx的截止时间作为写超时，ctx取消时中断写入
+func (c *Conn) WriteFrame(ctx context.Context, frame *Frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.rwc.SetWriteDeadline(deadline)
+	}
 
 	defer c.rwc.SetWriteDeadline(time.Time{})
 
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// 让阻塞的写立即返回
+			c.rwc.SetWriteDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
 	_, err := c.rwc.Write(frame.Bytes())
 
+	// 等待协程退出后再重置截止时间，避免其设置的截止时间影响下一次写
+	close(stop)
+	<-done
+
 	log.Debug().Str("write", fmt.Sprintf("% X", frame.Bytes())).Msg("")
 
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	return err
 }
 
+// Do 发送请求并等待对应的回复
+func (c *Conn) Do(ctx context.Context, req *Frame) (*Frame, error) {
+	if c.server != nil {
+		if !c.server.acquire() {
+			return nil, ErrServerClosed
+		}
+		defer c.server.inflight.Done()
+	}
+
+	cl := &call{
+		key:  req.Key(),
+		resp: make(chan *Frame, 1),
+	}
+
+	c.mu.Lock()
+	c.pending = append(c.pending, cl)
+	c.mu.Unlock()
+
+	if err := c.WriteFrame(ctx, req); err != nil {
+		c.remove(cl)
+		return nil, err
+	}
+
+	select {
+	case f := <-cl.resp:
+		return f, nil
+	case <-c.done:
+		c.remove(cl)
+		return nil, ErrClosed
+	case <-ctx.Done():
+		c.remove(cl)
+		return nil, ctx.Err()
+	}
+}
+
+// Context 连接关闭后取消
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
 func (c *Conn) Close() error {
 	return c.rwc.Close()
 }
@@ -60,21 +230,24 @@ func (c *Conn) Addr() net.Addr {
 	return c.rwc.RemoteAddr()
 }
 
-func (c *Conn) Lock() {
-	c.mu.Lock()
-}
-
-func (c *Conn) Unlock() {
-	c.mu.Unlock()
+// ConnectedAt 连接建立的时间
+func (c *Conn) ConnectedAt() time.Time {
+	return c.connectedAt
 }
 
 func NewServer(address string) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		address: address,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[*Conn]struct{}),
 	}
 }
 
-func (s *Server) SetServe(serve func(conn *Conn)) {
+// SetServe
+// serve的ctx在Shutdown时取消，serve应尽快返回，已发出的请求会继续等待回复
+func (s *Server) SetServe(serve func(ctx context.Context, conn *Conn)) {
 	s.serve = serve
 }
 
@@ -88,16 +261,130 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	return s.Serve(listener)
+}
+
+// Serve 在listener上接受连接，返回时关闭listener
+func (s *Server) Serve(listener net.Listener) error {
+	if s.serve == nil {
+		return errors.New("server error: use SetServe of server first")
+	}
+
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
 	defer listener.Close()
 	for {
 		rwc, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
+		conn := newConn(rwc, s)
+
+		if !s.track(conn) {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+
 		go func() {
-			s.serve(&Conn{rwc: rwc, server: s})
-			_ = rwc.Close()
+			defer s.serving.Done()
+
+			s.serve(s.ctx, conn)
+
+			// 关闭过程中由Shutdown在进行中的请求结束后统一关闭
+			if s.shuttingDown() {
+				return
+			}
+
+			s.untrack(conn)
+			_ = conn.Close()
 		}()
 	}
 }
+
+// Shutdown
+// 停止接受新连接，取消serve的ctx并拒绝新的请求，等待serve返回且进行中的请求结束后关闭所有连接
+// ctx结束时不再等待，直接关闭所有连接并返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) track(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// acquire 登记一个进行中的请求，关闭过程中返回false
+func (s *Server) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown {
+		return false
+	}
+
+	s.inflight.Add(1)
+	return true
+}
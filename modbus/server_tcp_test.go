@@ -0,0 +1,127 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"time"
+)
+
+type ServerTestSuite struct{}
+
+var _ = Suite(&ServerTestSuite{})
+
+// doResult Do的结果
+type doResult struct {
+	frame *Frame
+	err   error
+}
+
+// startServer 启动服务，每个连接的serve发出一个请求后返回，请求的结果写入results
+func startServer(c *C, results chan<- doResult) (*Server, string, <-chan error) {
+	f, err := NewFrame(teleindicationPacket)
+	c.Assert(err, IsNil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	server := NewServer(listener.Addr().String())
+	server.SetServe(func(ctx context.Context, conn *Conn) {
+		resp, err := conn.Do(context.Background(), NewTeleindication(f.ID))
+		results <- doResult{resp, err}
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	return server, listener.Addr().String(), served
+}
+
+// dial 连接服务并读取一个请求
+func dial(c *C, address string) net.Conn {
+	rwc, err := net.Dial("tcp", address)
+	c.Assert(err, IsNil)
+
+	_, err = NewDecoder(rwc).Decode()
+	c.Assert(err, IsNil)
+	return rwc
+}
+
+// closed 对端关闭后读取返回EOF
+func closed(c *C, rwc net.Conn) {
+	rwc.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := rwc.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *ServerTestSuite) TestShutdown(c *C) {
+	results := make(chan doResult, 1)
+	server, address, served := startServer(c, results)
+
+	rwc := dial(c, address)
+	defer rwc.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	// 不再接受新连接
+	c.Assert(errors.Is(<-served, ErrServerClosed), Equals, true)
+	_, err := net.Dial("tcp", address)
+	c.Assert(err, NotNil)
+
+	// 进行中的请求结束之前不关闭连接
+	select {
+	case err := <-shutdown:
+		c.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = rwc.Write(teleindicationPacket)
+	c.Assert(err, IsNil)
+
+	r := <-results
+	c.Assert(r.err, IsNil)
+	c.Assert(r.frame.Bytes(), DeepEquals, teleindicationPacket)
+
+	c.Assert(<-shutdown, IsNil)
+	closed(c, rwc)
+}
+
+func (s *ServerTestSuite) TestRejectAfterShutdown(c *C) {
+	server := NewServer("")
+	c.Assert(server.Shutdown(context.Background()), IsNil)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	conn := newConn(srv, server)
+	defer conn.Close()
+
+	_, err := conn.Do(context.Background(), NewTelemetering(id))
+	c.Assert(err, Equals, ErrServerClosed)
+}
+
+func (s *ServerTestSuite) TestForceClose(c *C) {
+	results := make(chan doResult, 1)
+	server, address, _ := startServer(c, results)
+
+	// 设备不回复
+	rwc := dial(c, address)
+	defer rwc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	c.Assert(server.Shutdown(ctx), Equals, context.DeadlineExceeded)
+
+	// 连接被关闭，请求随之结束
+	r := <-results
+	c.Assert(r.err, Equals, ErrClosed)
+	closed(c, rwc)
+}
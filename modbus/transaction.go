@@ -0,0 +1,97 @@
+package modbus
+
+import "encoding/binary"
+
+// Key
+// 用于将终端的回复与主站的请求对应起来
+// 同一个连接上，集中器下的多个节点可能同时有请求在等待回复，也可能主动上报故障、遥信，
+// 因此根据 节点地址+命令码+信息地址 来判断一帧是否是某个请求的回复
+type Key struct {
+	ID       ID
+	Function Function
+	Address  uint16 // 信息地址，0表示帧中没有信息地址
+}
+
+// 传送原因，遥信、遥测、遥控数据头的第2个字节
+const (
+	CauseSpontaneous   = 0x03 // 突发，终端主动上报
+	CauseActivation    = 0x06 // 激活，主站请求
+	CauseActivationCon = 0x07 // 激活确认，终端回复
+)
+
+type call struct {
+	key  Key
+	resp chan *Frame
+}
+
+// FromDevice 传输方向位，1表示终端发往主站
+func (c Ctrl) FromDevice() bool {
+	return c&0x80 != 0
+}
+
+// Cause 遥信、遥测、遥控帧的传送原因，忽略试验位和肯定/否定位，其他帧返回0
+func (f *Frame) Cause() byte {
+	switch f.Function {
+	case TeleFun, Telecontrol:
+		if len(f.Data) >= 2 {
+			return f.Data[1] & 0x3F
+		}
+	}
+	return 0
+}
+
+// Reply 帧是否可能是请求的回复：终端发出，遥信、遥测、遥控的传送原因为激活确认
+// 其他途径引起变化时终端会突发上报相同节点、相同信息地址的帧，不能当作轮询的回复
+func (f *Frame) Reply() bool {
+	if !f.Ctrl.FromDevice() {
+		return false
+	}
+
+	switch f.Function {
+	case TeleFun, Telecontrol:
+		return f.Cause() == CauseActivationCon
+	}
+	return true
+}
+
+// Key 返回帧的匹配键
+func (f *Frame) Key() Key {
+	k := Key{
+		ID:       f.ID,
+		Function: f.Function,
+	}
+
+	data := f.Data
+
+	switch f.Function {
+	case TeleFun, Telecontrol:
+		// 数据头5字节之后是信息地址
+		if len(data) >= 7 {
+			k.Address = binary.LittleEndian.Uint16(data[5:7])
+		}
+	case MultiReadFun:
+		// 读请求没有特征标识，回复有
+		if f.Ctrl.FromDevice() {
+			if len(data) >= 10 {
+				k.Address = binary.LittleEndian.Uint16(data[8:10])
+			}
+		} else if len(data) >= 9 {
+			k.Address = binary.LittleEndian.Uint16(data[7:9])
+		}
+	case MultiWriteFun:
+		// 写回复中没有信息地址
+		if !f.Ctrl.FromDevice() && len(data) >= 10 {
+			k.Address = binary.LittleEndian.Uint16(data[8:10])
+		}
+	}
+
+	return k
+}
+
+// Match 判断resp是否为请求k的回复，回复中没有信息地址时只匹配节点地址和命令码
+func (k Key) Match(resp Key) bool {
+	if k.ID != resp.ID || k.Function != resp.Function {
+		return false
+	}
+	return resp.Address == 0 || k.Address == resp.Address
+}
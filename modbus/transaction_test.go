@@ -0,0 +1,154 @@
+package modbus
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	TestingT(t)
+}
+
+type TransactionTestSuite struct{}
+
+var _ = Suite(&TransactionTestSuite{})
+
+// device 模拟集中器，读取一个请求后按顺序写出frames
+func device(c *C, rwc net.Conn, frames ...[]byte) {
+	go func() {
+		d := NewDecoder(rwc)
+		if _, err := d.Decode(); err != nil {
+			c.Error(err)
+			return
+		}
+		for _, f := range frames {
+			if _, err := rwc.Write(f); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+	}()
+}
+
+func (s *TransactionTestSuite) TestKey(c *C) {
+	f, err := NewFrame(teleindicationPacket)
+	c.Assert(err, IsNil)
+
+	req := NewTeleindication(f.ID)
+	c.Assert(req.Key(), Equals, Key{ID: f.ID, Function: TeleFun, Address: 0x4001})
+	c.Assert(req.Key().Match(f.Key()), Equals, true)
+	c.Assert(NewTelemetering(f.ID).Key().Match(f.Key()), Equals, false)
+
+	read := action("UnderVoltageTripSetting").ReadFrame(id)
+	c.Assert(read.Key().Address, Equals, uint16(0x8242))
+
+	write := action("UnderVoltageTripSetting").NewWriteFrame(id, []byte{0xA5, 0x00})
+	c.Assert(write.Key().Address, Equals, uint16(0x8242))
+	// 写回复没有信息地址
+	c.Assert(write.Key().Match(Key{ID: id, Function: MultiWriteFun}), Equals, true)
+}
+
+func (s *TransactionTestSuite) TestRequest(c *C) {
+	server, client := net.Pipe()
+	conn := newConn(server, nil)
+	defer conn.Close()
+
+	// 回复之前先上报了一个故障
+	device(c, client, faultPacket, teleindicationPacket)
+
+	f, err := NewFrame(teleindicationPacket)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := conn.Do(ctx, NewTeleindication(f.ID))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Bytes(), DeepEquals, teleindicationPacket)
+
+	unsolicited, err := conn.ReadFrame(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(unsolicited.Function, Equals, FaultFun)
+}
+
+func (s *TransactionTestSuite) TestSpontaneous(c *C) {
+	server, client := net.Pipe()
+	conn := newConn(server, nil)
+	defer conn.Close()
+
+	// 回复之前先突发上报了同一节点、同一信息地址的遥测
+	report := spontaneous(c, teleindicationPacket)
+	device(c, client, report, teleindicationPacket)
+
+	f, err := NewFrame(teleindicationPacket)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := conn.Do(ctx, NewTeleindication(f.ID))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Bytes(), DeepEquals, teleindicationPacket)
+
+	unsolicited, err := conn.ReadFrame(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(unsolicited.Bytes(), DeepEquals, report)
+}
+
+func (s *TransactionTestSuite) TestClosed(c *C) {
+	server, client := net.Pipe()
+	conn := newConn(server, nil)
+
+	go func() {
+		_, _ = NewDecoder(client).Decode()
+		_ = client.Close()
+	}()
+
+	_, err := conn.Do(context.Background(), NewTelemetering(id))
+	c.Assert(err, Equals, ErrClosed)
+
+	_, err = conn.ReadFrame(context.Background())
+	c.Assert(err, NotNil)
+	c.Assert(conn.Context().Err(), Equals, context.Canceled)
+}
+
+func (s *TransactionTestSuite) TestCancel(c *C) {
+	server, client := net.Pipe()
+	conn := newConn(server, nil)
+	defer conn.Close()
+
+	// 设备不回复
+	device(c, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := conn.Do(ctx, NewTelemetering(id))
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	// 没有读取者时写入因ctx取消而中断
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	c.Assert(conn.WriteFrame(ctx, NewTelemetering(id)), Equals, context.Canceled)
+}
+
+func (s *TransactionTestSuite) TestCancelAfterWrite(c *C) {
+	server, client := net.Pipe()
+	conn := newConn(server, nil)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	// 写完成时ctx恰好取消，不能影响下一次写
+	for i := 0; i < 5000; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go cancel()
+		_ = conn.WriteFrame(ctx, NewTelemetering(id))
+
+		c.Assert(conn.WriteFrame(context.Background(), NewTelemetering(id)), IsNil)
+	}
+}
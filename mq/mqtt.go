@@ -1,10 +1,18 @@
 package mq
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"github.com/eclipse/paho.mqtt.golang"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,10 +22,33 @@ const (
 	ExactlyOnce
 )
 
-var client mqtt.Client
+const (
+	publishTimeout   = 60 * time.Second
+	maxRetryInterval = 2 * time.Minute // 连接重试间隔的上限
+)
+
+var (
+	client  mqtt.Client
+	pending sync.WaitGroup // 尚未完成的发布
+
+	// queue 断开连接期间保存消息，打开失败时为nil，不缓存
+	queue *Queue
+	// 默认只缓存QoS大于0的事件，遥测数据量大且很快过时
+	bufferTelemetry = os.Getenv("MQTT_BUFFER_TELEMETRY") == "true"
 
+	mu        sync.Mutex
+	replaying bool // 正在补发，新消息需要排在队列之后
+
+	stateHandler func(connected bool)
+	connected    = expvar.NewInt("mq_connected")
+	closed       = make(chan struct{}) // Close时关闭，停止重试连接
+)
+
+// Init
+// MQTT_ADDRESS 可以用逗号分隔多个代理地址，连接断开后依次尝试
+// 设置 MQTT_CA_FILE 使用TLS，同时设置 MQTT_CERT_FILE 和 MQTT_KEY_FILE 使用双向认证
 func Init(clientId string) *mqtt.ClientOptions {
-	address := os.Getenv("MQTT_ADDRESS")
+	addresses := os.Getenv("MQTT_ADDRESS")
 	username := os.Getenv("MQTT_USERNAME")
 	password := os.Getenv("MQTT_PASSWORD")
 
@@ -26,19 +57,150 @@ func Init(clientId string) *mqtt.ClientOptions {
 		mqtt.ERROR = log.New(os.Stdout, "", 0)
 	}
 
-	return mqtt.NewClientOptions().
+	if queue == nil {
+		q, err := openQueue()
+		if err != nil {
+			log.Println("打开消息队列失败，断开期间的消息将不会缓存：", err)
+		}
+		queue = q
+	}
+
+	opts := mqtt.NewClientOptions().
 		SetClientID(clientId).
 		SetUsername(username).
 		SetPassword(password).
-		SetResumeSubs(true).AddBroker(address)
+		SetResumeSubs(true).
+		SetMaxReconnectInterval(maxRetryInterval)
+
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			opts.AddBroker(address)
+		}
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return opts
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("MQTT_CA_FILE")
+	certFile := os.Getenv("MQTT_CERT_FILE")
+	keyFile := os.Getenv("MQTT_KEY_FILE")
+
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("CA证书 %v 格式错误", caFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// SetClient 替换客户端，用于测试时记录发布的消息
+func SetClient(c mqtt.Client) {
+	client = c
+}
+
+// SetStateHandler 设置连接状态变化的回调，需要在Connect之前调用
+func SetStateHandler(f func(connected bool)) {
+	stateHandler = f
+}
+
+func setState(state bool) {
+	if state {
+		connected.Set(1)
+	} else {
+		connected.Set(0)
+	}
+
+	if stateHandler != nil {
+		stateHandler(state)
+	}
 }
 
+// Connect
+// 第一次连接失败时不退出，在后台按指数退避重试，期间发布的消息进入队列
 func Connect(opts *mqtt.ClientOptions) {
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		setState(true)
+		if onConnect != nil {
+			onConnect(c)
+		}
+		// 连接后补发断开期间缓存的消息
+		go replay()
+	})
+
+	onConnectionLost := opts.OnConnectionLost
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Println("连接断开：", err)
+		setState(false)
+		if onConnectionLost != nil {
+			onConnectionLost(c, err)
+		}
+	})
+
 	client = mqtt.NewClient(opts)
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+	token := client.Connect()
+	if token.Wait() && token.Error() == nil {
+		return
 	}
+
+	log.Println("连接失败：", token.Error())
+	setState(false)
+
+	go func() {
+		interval := time.Second
+		for {
+			select {
+			case <-closed:
+				return
+			case <-time.After(interval):
+			}
+
+			token := client.Connect()
+			if token.Wait() && token.Error() == nil {
+				return
+			}
+
+			log.Println("连接失败：", token.Error())
+
+			interval *= 2
+			if interval > maxRetryInterval {
+				interval = maxRetryInterval
+			}
+		}
+	}()
 }
 
 func Publish(topic string, qos byte, retained bool, data interface{}) {
@@ -47,9 +209,39 @@ func Publish(topic string, qos byte, retained bool, data interface{}) {
 		log.Println(err)
 		return
 	}
+
+	m := &message{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  payload,
+	}
+
+	if enqueue(m) {
+		return
+	}
+
+	publish(topic, qos, retained, payload)
+}
+
+// PublishRetained
+// 发布保留的状态消息，不进入队列，断开期间的变化由调用者在重新连接后重新发布，避免补发时旧状态覆盖新状态
+func PublishRetained(topic string, qos byte, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	publish(topic, qos, true, payload)
+}
+
+func publish(topic string, qos byte, retained bool, payload []byte) {
 	token := client.Publish(topic, qos, retained, payload)
+	pending.Add(1)
 	go func() {
-		ticker := time.NewTicker(60 * time.Second)
+		defer pending.Done()
+		ticker := time.NewTicker(publishTimeout)
 		defer ticker.Stop()
 		select {
 		// 无限期地等待令牌完成，即从代理发送发布和确认收据
@@ -62,3 +254,127 @@ func Publish(topic string, qos byte, retained bool, data interface{}) {
 		}
 	}()
 }
+
+// enqueue 断开连接或正在补发时将消息存入队列，返回消息是否已入队
+func enqueue(m *message) bool {
+	if queue == nil || (m.QoS == AtMostOnce && !bufferTelemetry) {
+		return false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if client.IsConnectionOpen() && !replaying {
+		return false
+	}
+
+	if err := queue.Push(m); err != nil {
+		log.Println("消息入队失败：", err)
+		return false
+	}
+
+	return true
+}
+
+// replay 按顺序补发队列中的消息，发布失败（通常是再次断开）时停止，等待下次连接
+func replay() {
+	if queue == nil {
+		return
+	}
+
+	mu.Lock()
+	if replaying {
+		mu.Unlock()
+		return
+	}
+	replaying = true
+	mu.Unlock()
+
+	defer func() {
+		mu.Lock()
+		replaying = false
+		mu.Unlock()
+	}()
+
+	for {
+		keys, messages, err := queue.Peek(100)
+		if err != nil {
+			log.Println("读取消息队列失败：", err)
+			return
+		}
+
+		if len(keys) == 0 {
+			mu.Lock()
+			// 持有锁时队列为空，之后的消息可以直接发布
+			if queue.Len() == 0 {
+				replaying = false
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+			continue
+		}
+
+		for i, m := range messages {
+			token := client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+			if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+				log.Println("补发消息失败：", token.Error())
+				_ = queue.Remove(keys[:i]...)
+				return
+			}
+		}
+
+		if err := queue.Remove(keys...); err != nil {
+			log.Println("删除已补发的消息失败：", err)
+			return
+		}
+	}
+}
+
+func openQueue() (*Queue, error) {
+	path := os.Getenv("MQTT_QUEUE_PATH")
+	if path == "" {
+		path = "data/mq.db"
+	}
+
+	size := 10000
+	if s := os.Getenv("MQTT_QUEUE_SIZE"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		size = v
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return OpenQueue(path, size)
+}
+
+// Close
+// 等待尚未完成的发布，最多等待timeout，然后断开连接
+func Close(timeout time.Duration) {
+	close(closed)
+
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("等待发布完成超时")
+	}
+
+	client.Disconnect(250)
+
+	if queue != nil {
+		if err := queue.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package mq
+
+import (
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+)
+
+type TLSTestSuite struct{}
+
+var _ = Suite(&TLSTestSuite{})
+
+func (s *TLSTestSuite) TestNone(c *C) {
+	tlsConfig, err := newTLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig, IsNil)
+}
+
+func (s *TLSTestSuite) TestInvalidCA(c *C) {
+	path := filepath.Join(c.MkDir(), "ca.pem")
+	c.Assert(os.WriteFile(path, []byte("not a certificate"), 0644), IsNil)
+
+	os.Setenv("MQTT_CA_FILE", path)
+	defer os.Unsetenv("MQTT_CA_FILE")
+
+	_, err := newTLSConfig()
+	c.Assert(err, NotNil)
+}
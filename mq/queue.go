@@ -0,0 +1,160 @@
+package mq
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var (
+	bucketName = []byte("messages")
+
+	// 队列指标，可通过 /debug/vars 查看
+	queueDepth   = expvar.NewInt("mq_queue_depth")
+	queueDropped = expvar.NewInt("mq_queue_dropped")
+)
+
+// message 待发布的消息
+type message struct {
+	Topic    string `json:"topic"`
+	QoS      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+	Payload  []byte `json:"payload"` // 采集时间等由调用者写在payload中，补发后仍是原始时间
+}
+
+// Queue
+// 基于bbolt的有界磁盘队列，MQTT断开期间保存待发布的消息，重连后按入队顺序补发
+// 队列满时丢弃最早的消息
+type Queue struct {
+	mu  sync.Mutex
+	db  *bolt.DB
+	max int
+	len int
+}
+
+func OpenQueue(path string, max int) (*Queue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{db: db, max: max}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		q.len = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	queueDepth.Set(int64(q.len))
+
+	return q, nil
+}
+
+// Push 消息入队
+func (q *Queue) Push(m *message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+
+		// 队列已满，丢弃最早的消息
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && q.len >= q.max; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			q.len--
+			queueDropped.Add(1)
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(key(seq), value); err != nil {
+			return err
+		}
+
+		q.len++
+		queueDepth.Set(int64(q.len))
+		return nil
+	})
+}
+
+// Peek 返回最早的n条消息及其键
+func (q *Queue) Peek(n int) ([][]byte, []*message, error) {
+	var keys [][]byte
+	var messages []*message
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.First(); k != nil && len(keys) < n; k, v = c.Next() {
+			var m message
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			messages = append(messages, &m)
+		}
+		return nil
+	})
+
+	return keys, messages, err
+}
+
+// Remove 删除已发布的消息
+func (q *Queue) Remove(keys ...[]byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, k := range keys {
+			// 可能已因队列满被丢弃
+			if b.Get(k) == nil {
+				continue
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			q.len--
+		}
+		queueDepth.Set(int64(q.len))
+		return nil
+	})
+}
+
+// Len 队列中的消息数量
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len
+}
+
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+func key(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
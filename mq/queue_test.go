@@ -0,0 +1,49 @@
+package mq
+
+import (
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	TestingT(t)
+}
+
+type QueueTestSuite struct{}
+
+var _ = Suite(&QueueTestSuite{})
+
+func (s *QueueTestSuite) TestOrder(c *C) {
+	path := filepath.Join(c.MkDir(), "mq.db")
+
+	q, err := OpenQueue(path, 3)
+	c.Assert(err, IsNil)
+
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		c.Assert(q.Push(&message{Topic: topic}), IsNil)
+	}
+
+	// 超出容量丢弃最早的消息
+	c.Assert(q.Len(), Equals, 3)
+
+	keys, messages, err := q.Peek(2)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Topic, Equals, "b")
+	c.Assert(messages[1].Topic, Equals, "c")
+
+	c.Assert(q.Remove(keys...), IsNil)
+	c.Assert(q.Len(), Equals, 1)
+	c.Assert(q.Close(), IsNil)
+
+	// 重启后消息仍在
+	q, err = OpenQueue(path, 3)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	c.Assert(q.Len(), Equals, 1)
+	_, messages, err = q.Peek(10)
+	c.Assert(err, IsNil)
+	c.Assert(messages[0].Topic, Equals, "d")
+}
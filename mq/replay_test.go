@@ -0,0 +1,131 @@
+package mq
+
+import (
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ReplayTestSuite struct{}
+
+var _ = Suite(&ReplayTestSuite{})
+
+// fakeClient 记录发布的消息，fail次发布之后的发布失败
+type fakeClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	fail      int // 为0时不失败
+	published []string
+}
+
+func (f *fakeClient) IsConnectionOpen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *fakeClient) Publish(topic string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail > 0 && len(f.published) >= f.fail {
+		return &fakeToken{err: errors.New("not connected")}
+	}
+
+	f.published = append(f.published, topic)
+	return &fakeToken{}
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool {
+	return true
+}
+
+func (t *fakeToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (t *fakeToken) Error() error {
+	return t.err
+}
+
+func (s *ReplayTestSuite) SetUpTest(c *C) {
+	q, err := OpenQueue(filepath.Join(c.MkDir(), "mq.db"), 100)
+	c.Assert(err, IsNil)
+	queue = q
+}
+
+func (s *ReplayTestSuite) TearDownTest(c *C) {
+	c.Assert(queue.Close(), IsNil)
+	queue = nil
+	client = nil
+}
+
+func (s *ReplayTestSuite) TestReplay(c *C) {
+	fake := &fakeClient{}
+	client = fake
+
+	// 断开期间的事件入队，遥测不缓存直接发布
+	for _, topic := range []string{"a", "b", "c"} {
+		Publish(topic, AtLeastOnce, false, topic)
+	}
+	Publish("telemetry", AtMostOnce, false, "telemetry")
+
+	c.Assert(queue.Len(), Equals, 3)
+	c.Assert(fake.published, DeepEquals, []string{"telemetry"})
+
+	// 重新连接后按入队顺序补发并删除
+	fake.connected = true
+	fake.published = nil
+	replay()
+
+	c.Assert(fake.published, DeepEquals, []string{"a", "b", "c"})
+	c.Assert(queue.Len(), Equals, 0)
+
+	// 补发结束后直接发布
+	Publish("d", AtLeastOnce, false, "d")
+	c.Assert(fake.published, DeepEquals, []string{"a", "b", "c", "d"})
+	c.Assert(queue.Len(), Equals, 0)
+}
+
+func (s *ReplayTestSuite) TestReplayFailure(c *C) {
+	fake := &fakeClient{}
+	client = fake
+
+	for _, topic := range []string{"a", "b", "c"} {
+		Publish(topic, AtLeastOnce, false, topic)
+	}
+
+	// 补发第2条时再次断开，已发布的删除，其余留在队列中
+	fake.connected = true
+	fake.fail = 1
+	replay()
+
+	c.Assert(fake.published, DeepEquals, []string{"a"})
+	c.Assert(queue.Len(), Equals, 2)
+
+	_, messages, err := queue.Peek(10)
+	c.Assert(err, IsNil)
+	c.Assert(messages[0].Topic, Equals, "b")
+	c.Assert(messages[1].Topic, Equals, "c")
+
+	fake.fail = 0
+	replay()
+
+	c.Assert(fake.published, DeepEquals, []string{"a", "b", "c"})
+	c.Assert(queue.Len(), Equals, 0)
+}
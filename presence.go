@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"ricn-smart/jg-gw/mq"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 实例状态
+const (
+	instanceOnline  = "ONLINE"
+	instanceOffline = "OFFLINE"
+)
+
+// 实例下线原因
+const (
+	reasonConnectionLost = "CONNECTION_LOST" // 遗嘱消息，实例异常退出或与代理断开
+)
+
+// instanceID 当前实例的MQTT客户端ID
+var instanceID string
+
+// presenceMu 保证所属集中器列表按变化的顺序发布
+var presenceMu sync.Mutex
+
+// statusTopic
+// 实例状态，保留消息，实例异常退出时由代理发布遗嘱消息
+// 云端收到OFFLINE后可以将 snsTopic 中的集中器全部标记为离线
+func statusTopic() string {
+	return ProjectName + "/instances/" + instanceID + "/status"
+}
+
+// snsTopic 实例当前连接的集中器sn列表，保留消息
+func snsTopic() string {
+	return ProjectName + "/instances/" + instanceID + "/sns"
+}
+
+// willPayload 遗嘱消息在连接时交给代理，不带时间
+func willPayload() map[string]any {
+	return map[string]any{
+		"Status": instanceOffline,
+		"Reason": reasonConnectionLost,
+	}
+}
+
+func publishStatus(status string, reason string) {
+	payload := map[string]any{
+		"Status": status,
+		"Commit": GitCommitID,
+		"Time":   time.Now().UnixMilli(),
+	}
+
+	if reason != "" {
+		payload["Reason"] = reason
+	}
+
+	// 与遗嘱消息相同的QoS，避免上线状态丢失后遗嘱消息一直保留
+	mq.PublishRetained(statusTopic(), mq.AtLeastOnce, payload)
+}
+
+// publishSns 集中器上线、下线后发布所属集中器列表，重新连接代理后也会重新发布
+func publishSns() {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+
+	sns := make([]string, 0)
+	snConn.Range(func(sn string, _ *session) bool {
+		sns = append(sns, sn)
+		return true
+	})
+	sort.Strings(sns)
+
+	log.Debug().Strs("sns", sns).Msg("所属集中器")
+
+	mq.PublishRetained(snsTopic(), mq.AtLeastOnce, map[string]any{
+		"Sns":  sns,
+		"Time": time.Now().UnixMilli(),
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/eclipse/paho.mqtt.golang"
+	. "gopkg.in/check.v1"
+	"ricn-smart/jg-gw/mq"
+	"sync"
+	"time"
+)
+
+type PresenceTestSuite struct{}
+
+var _ = Suite(&PresenceTestSuite{})
+
+// fakeClient 记录发布的消息
+type fakeClient struct {
+	mqtt.Client
+
+	mu       sync.Mutex
+	messages []*published
+}
+
+type published struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  map[string]any
+}
+
+// installClient 用fakeClient替换mq的客户端，返回的函数恢复
+func installClient() (*fakeClient, func()) {
+	f := &fakeClient{}
+	mq.SetClient(f)
+	return f, func() {
+		mq.SetClient(nil)
+	}
+}
+
+func (f *fakeClient) IsConnectionOpen() bool {
+	return true
+}
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	m := &published{topic: topic, qos: qos, retained: retained}
+	_ = json.Unmarshal(payload.([]byte), &m.payload)
+
+	f.mu.Lock()
+	f.messages = append(f.messages, m)
+	f.mu.Unlock()
+
+	return &fakeToken{}
+}
+
+// published 发布到topic的消息
+func (f *fakeClient) published(topic string) []*published {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var messages []*published
+	for _, m := range f.messages {
+		if m.topic == topic {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// identifiers 发布到topic的事件标识符
+func (f *fakeClient) identifiers(topic string) []string {
+	var identifiers []string
+	for _, m := range f.published(topic) {
+		identifiers = append(identifiers, m.payload["Identifier"].(string))
+	}
+	return identifiers
+}
+
+type fakeToken struct{}
+
+func (t *fakeToken) Wait() bool {
+	return true
+}
+
+func (t *fakeToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (t *fakeToken) Error() error {
+	return nil
+}
+
+func (s *PresenceTestSuite) TestStatus(c *C) {
+	fake, restore := installClient()
+	defer restore()
+
+	instanceID = "jg-gw-1"
+	c.Assert(statusTopic(), Equals, ProjectName+"/instances/jg-gw-1/status")
+	c.Assert(snsTopic(), Equals, ProjectName+"/instances/jg-gw-1/sns")
+
+	c.Assert(willPayload(), DeepEquals, map[string]any{"Status": instanceOffline, "Reason": reasonConnectionLost})
+
+	publishStatus(instanceOnline, "")
+	publishStatus(instanceOffline, reasonShutdown)
+
+	messages := fake.published(statusTopic())
+	c.Assert(messages, HasLen, 2)
+
+	// 与遗嘱消息一样为保留消息，QoS 1
+	for _, m := range messages {
+		c.Assert(m.retained, Equals, true)
+		c.Assert(m.qos, Equals, mq.AtLeastOnce)
+		c.Assert(m.payload["Time"], NotNil)
+	}
+
+	c.Assert(messages[0].payload["Status"], Equals, instanceOnline)
+	c.Assert(messages[0].payload["Reason"], IsNil)
+	c.Assert(messages[1].payload["Status"], Equals, instanceOffline)
+	c.Assert(messages[1].payload["Reason"], Equals, reasonShutdown)
+}
+
+func (s *PresenceTestSuite) TestSns(c *C) {
+	fake, restore := installClient()
+	defer restore()
+
+	instanceID = "jg-gw-1"
+
+	publishSns()
+
+	snConn.Store("182112180129", &session{})
+	snConn.Store(sn, &session{})
+	defer snConn.Delete("182112180129")
+	defer snConn.Delete(sn)
+
+	publishSns()
+
+	messages := fake.published(snsTopic())
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].payload["Sns"], DeepEquals, []any{})
+	// 按sn排序
+	c.Assert(messages[1].payload["Sns"], DeepEquals, []any{sn, "182112180129"})
+	c.Assert(messages[1].retained, Equals, true)
+	c.Assert(messages[1].qos, Equals, mq.AtLeastOnce)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+	"reflect"
+	"ricn-smart/jg-gw/modbus"
+	"time"
+)
+
+// reportConfig 按变化上报的配置
+type reportConfig struct {
+	Integrity duration            `json:"integrity"` // 节点超过该时间未全量发布时，发布节点所有属性，0表示每次都全量发布
+	Deadbands map[string]deadband `json:"deadbands"` // 按属性名配置模拟量的死区，未配置的属性有变化就发布
+}
+
+// deadband 死区，变化超过任一死区即发布
+type deadband struct {
+	Absolute float64 `json:"absolute"` // 绝对值
+	Percent  float64 `json:"percent"`  // 相对上次发布值的百分比
+}
+
+// reporter
+// 记录节点每个属性上次发布的值，只发布有变化的属性
+// 开关量有变化立即发布，模拟量变化超过死区才发布，并定期全量发布保证云端数据完整
+type reporter struct {
+	cfg       reportConfig
+	values    map[string]any // 上次发布的值
+	current   map[string]any // 最近读到的值，遥信、遥测分别轮询，全量发布时一起发布
+	published time.Time      // 上次全量发布的时间
+}
+
+func newReporter(cfg reportConfig) *reporter {
+	return &reporter{
+		cfg:     cfg,
+		values:  make(map[string]any),
+		current: make(map[string]any),
+	}
+}
+
+// filter 返回需要发布的属性，并记录为已发布
+// 节点超过全量发布间隔时，返回节点所有属性的最近值，不考虑死区
+func (r *reporter) filter(values map[string]any, now time.Time) map[string]any {
+	for name, value := range values {
+		r.current[name] = value
+	}
+
+	changed := make(map[string]any)
+
+	if r.published.IsZero() || now.Sub(r.published) >= time.Duration(r.cfg.Integrity) {
+		for name, value := range r.current {
+			changed[name] = value
+			r.values[name] = value
+		}
+		r.published = now
+		return changed
+	}
+
+	for name, value := range values {
+		if last, ok := r.values[name]; ok && !r.changed(name, last, value) {
+			continue
+		}
+
+		changed[name] = value
+		r.values[name] = value
+	}
+
+	return changed
+}
+
+func (r *reporter) changed(name string, last, value any) bool {
+	band, ok := r.cfg.Deadbands[name]
+	if !ok {
+		return !reflect.DeepEqual(last, value)
+	}
+
+	l, ok1 := toDecimal(last)
+	v, ok2 := toDecimal(value)
+	if !ok1 || !ok2 {
+		return !reflect.DeepEqual(last, value)
+	}
+
+	diff := v.Sub(l).Abs()
+
+	if band.Absolute <= 0 && band.Percent <= 0 {
+		return !diff.IsZero()
+	}
+
+	if band.Absolute > 0 && diff.GreaterThan(decimal.NewFromFloat(band.Absolute)) {
+		return true
+	}
+
+	if band.Percent > 0 && diff.GreaterThan(l.Abs().Mul(decimal.NewFromFloat(band.Percent)).Div(decimal.NewFromInt(100))) {
+		return true
+	}
+
+	return false
+}
+
+func toDecimal(v any) (decimal.Decimal, bool) {
+	switch v := v.(type) {
+	case decimal.Decimal:
+		return v, true
+	case modbus.Number:
+		return v.Decimal, true
+	case uint8:
+		return decimal.NewFromInt(int64(v)), true
+	case uint16:
+		return decimal.NewFromInt(int64(v)), true
+	case int:
+		return decimal.NewFromInt(int64(v)), true
+	case float64:
+		return decimal.NewFromFloat(v), true
+	default:
+		return decimal.Decimal{}, false
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ReportTestSuite struct{}
+
+var _ = Suite(&ReportTestSuite{})
+
+func (s *ReportTestSuite) TestFilter(c *C) {
+	r := newReporter(reportConfig{
+		Integrity: duration(10 * time.Minute),
+		Deadbands: map[string]deadband{
+			"Ua":      {Absolute: 1},
+			"Ia":      {Percent: 10},
+			"Leakage": {},
+		},
+	})
+
+	now := time.Now()
+
+	values := map[string]any{
+		"Switch":  uint8(1),
+		"Ua":      decimal.RequireFromString("220.0"),
+		"Ia":      decimal.RequireFromString("10.00"),
+		"Leakage": decimal.RequireFromString("5"),
+	}
+
+	// 第一次全部发布
+	c.Assert(r.filter(values, now), HasLen, 4)
+
+	// 在死区内
+	c.Assert(r.filter(map[string]any{
+		"Switch":  uint8(1),
+		"Ua":      decimal.RequireFromString("220.9"),
+		"Ia":      decimal.RequireFromString("10.90"),
+		"Leakage": decimal.RequireFromString("5"),
+	}, now.Add(time.Minute)), HasLen, 0)
+
+	// 开关量变化立即发布，模拟量超过死区
+	changed := r.filter(map[string]any{
+		"Switch":  uint8(0),
+		"Ua":      decimal.RequireFromString("221.1"),
+		"Ia":      decimal.RequireFromString("11.10"),
+		"Leakage": decimal.RequireFromString("6"),
+	}, now.Add(2*time.Minute))
+	c.Assert(changed, HasLen, 4)
+
+	// 在死区内的变化不发布，发布值仍是上次的
+	c.Assert(r.filter(map[string]any{
+		"Ua": decimal.RequireFromString("221.5"),
+	}, now.Add(5*time.Minute)), HasLen, 0)
+
+	// 超过全量发布间隔，节点所有属性的最近值一起发布，不考虑死区
+	changed = r.filter(map[string]any{
+		"Switch": uint8(0),
+	}, now.Add(10*time.Minute))
+	c.Assert(changed, DeepEquals, map[string]any{
+		"Switch":  uint8(0),
+		"Ua":      decimal.RequireFromString("221.5"),
+		"Ia":      decimal.RequireFromString("11.10"),
+		"Leakage": decimal.RequireFromString("6"),
+	})
+
+	// 全量发布间隔从全量发布时重新计算
+	c.Assert(r.filter(values, now.Add(11*time.Minute)), HasLen, 3)
+	c.Assert(r.filter(values, now.Add(19*time.Minute)), HasLen, 0)
+	c.Assert(r.filter(values, now.Add(20*time.Minute)), HasLen, 4)
+}
+
+func (s *ReportTestSuite) TestNoIntegrity(c *C) {
+	r := newReporter(reportConfig{})
+
+	values := map[string]any{"Switch": uint8(1)}
+
+	now := time.Now()
+	c.Assert(r.filter(values, now), HasLen, 1)
+	c.Assert(r.filter(values, now), HasLen, 1)
+}
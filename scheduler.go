@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"ricn-smart/jg-gw/modbus"
+	"ricn-smart/jg-gw/mq"
+	"sync"
+	"time"
+)
+
+// pollKind 轮询的数据类型
+type pollKind int
+
+const (
+	pollTelemetering   pollKind = iota // 遥信
+	pollTeleindication                 // 遥测
+	pollSettings                       // 定值
+	pollKinds
+)
+
+func (k pollKind) String() string {
+	switch k {
+	case pollTelemetering:
+		return "telemetering"
+	case pollTeleindication:
+		return "teleindication"
+	case pollSettings:
+		return "settings"
+	default:
+		return "unknown"
+	}
+}
+
+// scheduler
+// 按各自的间隔轮询集中器下节点的遥信、遥测和定值
+// 同一集中器的轮询依次进行，每个请求前都会让位给正在执行的命令
+type scheduler struct {
+	s       *session
+	sn      string
+	cfg     pollConfig
+	breaker breakerConfig
+	report  reportConfig
+
+	// 按节点地址，只在轮询协程中访问
+	breakers  map[string]*breaker
+	reporters map[string]*reporter
+
+	wg sync.WaitGroup
+}
+
+func newScheduler(s *session, sn string, cfg gatewayConfig) *scheduler {
+	return &scheduler{
+		s:         s,
+		sn:        sn,
+		cfg:       cfg.Poll,
+		breaker:   cfg.Breaker,
+		report:    cfg.Report,
+		breakers:  make(map[string]*breaker),
+		reporters: make(map[string]*reporter),
+	}
+}
+
+func (p *scheduler) start(ctx context.Context) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.run(ctx)
+	}()
+}
+
+// wait 等待轮询协程退出
+func (p *scheduler) wait() {
+	p.wg.Wait()
+}
+
+func (p *scheduler) interval(kind pollKind) time.Duration {
+	switch kind {
+	case pollTelemetering:
+		return time.Duration(p.cfg.Telemetering)
+	case pollTeleindication:
+		return time.Duration(p.cfg.Teleindication)
+	case pollSettings:
+		return time.Duration(p.cfg.Settings)
+	default:
+		return 0
+	}
+}
+
+func (p *scheduler) jitter() time.Duration {
+	if p.cfg.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(p.cfg.Jitter)))
+}
+
+func (p *scheduler) run(ctx context.Context) {
+	var next [pollKinds]time.Time
+
+	now := time.Now()
+	for kind := pollKind(0); kind < pollKinds; kind++ {
+		if p.interval(kind) > 0 {
+			next[kind] = now.Add(p.jitter())
+		}
+	}
+
+	for {
+		var due time.Time
+		for _, t := range next {
+			if !t.IsZero() && (due.IsZero() || t.Before(due)) {
+				due = t
+			}
+		}
+
+		// 所有类型都不需要轮询
+		if due.IsZero() {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		for kind := pollKind(0); kind < pollKinds; kind++ {
+			if next[kind].IsZero() || next[kind].After(time.Now()) {
+				continue
+			}
+
+			p.poll(ctx, kind)
+
+			next[kind] = time.Now().Add(p.interval(kind) + p.jitter())
+		}
+	}
+}
+
+// poll 依次轮询每个启用的节点，单个节点失败不影响其他节点
+// 集中器掉电期间节点已失电，不轮询，避免误报为不可达
+func (p *scheduler) poll(ctx context.Context, kind pollKind) {
+	sn := p.sn
+
+	for _, id := range p.s.Nodes() {
+		if ctx.Err() != nil || p.s.poweredDown.Load() {
+			return
+		}
+
+		node := id.String()
+
+		if !p.cfg.enabled(node) {
+			continue
+		}
+
+		b, ok := p.breakers[node]
+		if !ok {
+			b = newBreaker(p.breaker)
+			p.breakers[node] = b
+		}
+
+		// 退避中的节点本轮跳过
+		if !b.allow(time.Now()) {
+			continue
+		}
+
+		data, err := p.read(kind, id)
+		if err != nil {
+			log.Error().Err(err).Str("sn", sn).Str("node", node).Stringer("kind", kind).Msg("轮询失败")
+
+			// 服务关闭或轮询期间掉电引起的失败不计入
+			if ctx.Err() != nil || p.s.poweredDown.Load() {
+				return
+			}
+
+			if b.failure(time.Now()) {
+				log.Warn().Str("sn", sn).Str("node", node).Int("failures", b.failures).Msg("节点不可达")
+				publishNodeEvent(sn, node, "UNREACHABLE", map[string]any{"Failures": b.failures, "Error": err.Error()})
+			}
+			continue
+		}
+
+		if b.success() {
+			log.Info().Str("sn", sn).Str("node", node).Msg("节点恢复")
+			publishNodeEvent(sn, node, "REACHABLE", nil)
+		}
+
+		log.Debug().Str("sn", sn).Interface("data", data).Str("node", node).Stringer("kind", kind).Msg("轮询")
+
+		r, ok := p.reporters[node]
+		if !ok {
+			r = newReporter(p.report)
+			p.reporters[node] = r
+		}
+
+		now := time.Now()
+
+		updateShadow(sn, node, data, now, time.Duration(p.report.Integrity))
+
+		// 只发布有变化的属性
+		data = r.filter(data, now)
+		if len(data) == 0 {
+			continue
+		}
+
+		// 采集时间，断开期间缓存的数据补发后仍能知道原始时间
+		data["Time"] = now.UnixMilli()
+
+		mq.Publish(ProjectName+"/"+sn+"/"+node+"/property", mq.AtMostOnce, false, data)
+	}
+}
+
+func (p *scheduler) read(kind pollKind, id modbus.ID) (map[string]any, error) {
+	timeout := time.Duration(p.cfg.Timeout)
+
+	data := make(map[string]any)
+
+	switch kind {
+	case pollTelemetering:
+		// 遥信读取开关状态
+		resp, err := p.s.poll(modbus.NewTelemetering(id), timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := resp.NewTelemeteringAck(data); err != nil {
+			return nil, err
+		}
+	case pollTeleindication:
+		// 遥测读取电压等数据
+		resp, err := p.s.poll(modbus.NewTeleindication(id), timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := resp.NewTeleindicationAck(data); err != nil {
+			return nil, err
+		}
+	case pollSettings:
+		var registers []*modbus.ActionRegister
+		for _, r := range modbus.AllRegister {
+			if ar, ok := r.(*modbus.ActionRegister); ok && ar.Access().CanRead() {
+				registers = append(registers, ar)
+			}
+		}
+
+		// 尽量一帧读取多个定值
+		for _, batch := range modbus.Batch(registers) {
+			resp, err := p.s.poll(modbus.NewMultiReadFrame(id, batch), timeout)
+			if err != nil {
+				return nil, err
+			}
+
+			values, err := modbus.ParseMultiReadResp(resp, batch)
+			if err != nil {
+				return nil, err
+			}
+
+			for k, v := range values {
+				data[k] = v
+			}
+		}
+	}
+
+	return data, nil
+}
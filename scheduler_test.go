@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"ricn-smart/jg-gw/modbus"
+	"time"
+)
+
+type SchedulerTestSuite struct{}
+
+var _ = Suite(&SchedulerTestSuite{})
+
+// secondNode 集中器下的第二个节点
+const secondNode = "072107630290"
+
+// newPollGateway 连接fakeDevice，集中器下有两个节点，返回按cfg轮询的scheduler
+func newPollGateway(c *C, d *fakeDevice, cfg gatewayConfig) (*session, *scheduler, []modbus.ID, func()) {
+	gateway, closeGateway := newGateway(c, d)
+
+	var nodes []modbus.ID
+	for _, node := range []string{childDeviceNo, secondNode} {
+		id, err := modbus.NewID(node)
+		c.Assert(err, IsNil)
+		nodes = append(nodes, id)
+	}
+	gateway.setNodes(nodes)
+
+	return gateway, newScheduler(gateway, sn, cfg), nodes, func() {
+		closeGateway()
+
+		shadows.mu.Lock()
+		for _, node := range []string{childDeviceNo, secondNode} {
+			delete(shadows.m, sn+"/"+node)
+		}
+		shadows.mu.Unlock()
+	}
+}
+
+// requests fakeDevice收到的请求的功能码和节点地址
+func (d *fakeDevice) requests() ([]modbus.Function, []modbus.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]modbus.Function(nil), d.functions...), append([]modbus.ID(nil), d.nodes...)
+}
+
+func (s *SchedulerTestSuite) TestInterval(c *C) {
+	p := &scheduler{cfg: pollConfig{
+		Telemetering: duration(time.Minute),
+		Settings:     duration(time.Hour),
+		Jitter:       duration(time.Second),
+	}}
+
+	c.Assert(p.interval(pollTelemetering), Equals, time.Minute)
+	c.Assert(p.interval(pollTeleindication), Equals, time.Duration(0))
+	c.Assert(p.interval(pollSettings), Equals, time.Hour)
+
+	for i := 0; i < 100; i++ {
+		jitter := p.jitter()
+		c.Assert(jitter >= 0 && jitter < time.Second, Equals, true, Commentf("%v", jitter))
+	}
+
+	p.cfg.Jitter = 0
+	c.Assert(p.jitter(), Equals, time.Duration(0))
+
+	// 所有类型都不轮询时立即退出
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&scheduler{}).run(context.Background())
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("run did not return")
+	}
+}
+
+func (s *SchedulerTestSuite) TestRun(c *C) {
+	_, restore := installClient()
+	defer restore()
+
+	cfg := defaultConfig().Default
+	cfg.Poll = pollConfig{Telemetering: duration(30 * time.Millisecond), Timeout: duration(time.Second)}
+
+	d := &fakeDevice{}
+	_, p, _, closeGateway := newPollGateway(c, d, cfg)
+	defer closeGateway()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	p.start(ctx)
+	p.wait()
+
+	// 约在0、30、60、90ms各轮询一次，每次两个节点，间隔为0的遥测和定值不轮询
+	functions, _ := d.requests()
+	c.Assert(len(functions) >= 4 && len(functions) <= 10, Equals, true, Commentf("%v", functions))
+	for _, f := range functions {
+		c.Assert(f, Equals, modbus.TeleFun)
+	}
+}
+
+func (s *SchedulerTestSuite) TestDisabledNode(c *C) {
+	_, restore := installClient()
+	defer restore()
+
+	cfg := defaultConfig().Default
+	cfg.Poll.Nodes = map[string]bool{secondNode: false}
+
+	d := &fakeDevice{}
+	_, p, nodes, closeGateway := newPollGateway(c, d, cfg)
+	defer closeGateway()
+
+	p.poll(context.Background(), pollTelemetering)
+
+	_, ids := d.requests()
+	c.Assert(ids, DeepEquals, nodes[:1])
+}
+
+func (s *SchedulerTestSuite) TestBreaker(c *C) {
+	fake, restore := installClient()
+	defer restore()
+
+	cfg := defaultConfig().Default
+	cfg.Poll.Timeout = duration(50 * time.Millisecond)
+	cfg.Breaker = breakerConfig{Threshold: 1, Backoff: duration(time.Hour), MaxBackoff: duration(time.Hour)}
+
+	d := &fakeDevice{}
+	_, p, nodes, closeGateway := newPollGateway(c, d, cfg)
+	defer closeGateway()
+
+	// 第一个节点不回复
+	d.mu.Lock()
+	d.mute = map[modbus.ID]bool{nodes[0]: true}
+	d.mu.Unlock()
+
+	p.poll(context.Background(), pollTelemetering)
+	c.Assert(fake.identifiers(ProjectName+"/"+sn+"/"+childDeviceNo+"/event"), DeepEquals, []string{"UNREACHABLE"})
+
+	// 退避期间跳过不回复的节点，不影响其他节点
+	p.poll(context.Background(), pollTelemetering)
+
+	_, ids := d.requests()
+	c.Assert(ids, DeepEquals, []modbus.ID{nodes[0], nodes[1], nodes[1]})
+	c.Assert(fake.published(ProjectName+"/"+sn+"/"+secondNode+"/property"), HasLen, 1)
+}
+
+func (s *SchedulerTestSuite) TestPreempt(c *C) {
+	_, restore := installClient()
+	defer restore()
+
+	cfg := defaultConfig().Default
+	cfg.Poll.Timeout = duration(200 * time.Millisecond)
+
+	d := &fakeDevice{}
+	gateway, p, nodes, closeGateway := newPollGateway(c, d, cfg)
+	defer closeGateway()
+
+	// 第一个节点不回复，轮询请求等到超时
+	d.mu.Lock()
+	d.mute = map[modbus.ID]bool{nodes[0]: true}
+	d.mu.Unlock()
+
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		p.poll(context.Background(), pollTelemetering)
+	}()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if functions, _ := d.requests(); len(functions) > 0 {
+			break
+		}
+		c.Assert(time.Now().Before(deadline), Equals, true)
+	}
+
+	// 命令最多等待正在进行的一个轮询请求，之后先于剩余的轮询执行
+	set := &setPropertyRequest{
+		Identifiers:   []string{"Switch"},
+		ChildDeviceNo: secondNode,
+		Params:        map[string]any{"Switch": 1},
+	}
+
+	start := time.Now()
+	results, err := set.do(gateway)
+	c.Assert(err, IsNil)
+	c.Assert(results["Switch"].Success, Equals, true)
+	c.Assert(time.Since(start) < time.Duration(cfg.Poll.Timeout)+100*time.Millisecond, Equals, true)
+
+	<-polled
+
+	functions, ids := d.requests()
+	c.Assert(functions, DeepEquals, []modbus.Function{modbus.TeleFun, modbus.Telecontrol, modbus.TeleFun})
+	c.Assert(ids, DeepEquals, []modbus.ID{nodes[0], nodes[1], nodes[1]})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"ricn-smart/jg-gw/mq"
+	"sync"
+	"time"
+)
+
+// shadow
+// 节点最近一次读到的状态，包括遥信、遥测和定值
+// 有属性变化时发布到保留主题 <project>/<sn>/<node>/shadow，新订阅的客户端立即得到当前状态
+// 没有变化时按完整性周期发布，期间保留消息中的读取时间和LastSeen不会更新
+type shadow struct {
+	Properties map[string]*shadowValue `json:"Properties"`
+	LastSeen   int64                   `json:"LastSeen"` // 最近一次收到节点数据的时间，单位毫秒
+
+	published time.Time // 最近一次发布的时间
+}
+
+type shadowValue struct {
+	Value any   `json:"Value"`
+	Time  int64 `json:"Time"` // 读取时间，单位毫秒
+}
+
+// shadows 按 sn/node 保存，集中器重连后仍保留
+var shadows = struct {
+	mu sync.Mutex
+	m  map[string]*shadow
+}{m: make(map[string]*shadow)}
+
+func shadowTopic(sn string, node string) string {
+	return ProjectName + "/" + sn + "/" + node + "/shadow"
+}
+
+// updateShadow 记录解码得到的属性，有属性变化或距上次发布超过integrity时发布，integrity为0时每次都发布
+// 无论是否发布，缓存中的读取时间都会更新，供max_age使用
+func updateShadow(sn string, node string, values map[string]any, now time.Time, integrity time.Duration) {
+	if sn == "" || len(values) == 0 {
+		return
+	}
+
+	shadows.mu.Lock()
+	defer shadows.mu.Unlock()
+
+	key := sn + "/" + node
+
+	s, ok := shadows.m[key]
+	if !ok {
+		s = &shadow{Properties: make(map[string]*shadowValue)}
+		shadows.m[key] = s
+	}
+
+	if !s.update(values, now, integrity) {
+		return
+	}
+
+	// 持有锁时发布，保证保留消息的顺序与更新顺序一致
+	mq.PublishRetained(shadowTopic(sn, node), mq.AtMostOnce, s)
+}
+
+// update 记录属性，返回是否需要发布
+func (s *shadow) update(values map[string]any, now time.Time, integrity time.Duration) bool {
+	changed := false
+
+	ms := now.UnixMilli()
+	for name, value := range values {
+		if last, ok := s.Properties[name]; !ok || !equal(last.Value, value) {
+			changed = true
+		}
+		s.Properties[name] = &shadowValue{Value: value, Time: ms}
+	}
+	s.LastSeen = ms
+
+	if !changed && now.Sub(s.published) < integrity {
+		return false
+	}
+
+	s.published = now
+	return true
+}
+
+// cached 返回读取时间在maxAge以内的属性
+func cached(sn string, node string, identifiers []string, maxAge time.Duration, now time.Time) map[string]any {
+	shadows.mu.Lock()
+	defer shadows.mu.Unlock()
+
+	values := make(map[string]any)
+
+	s, ok := shadows.m[sn+"/"+node]
+	if !ok {
+		return values
+	}
+
+	for _, identifier := range identifiers {
+		v, ok := s.Properties[identifier]
+		if ok && now.Sub(time.UnixMilli(v.Time)) <= maxAge {
+			values[identifier] = v.Value
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ShadowTestSuite struct{}
+
+var _ = Suite(&ShadowTestSuite{})
+
+func (s *ShadowTestSuite) TestCached(c *C) {
+	now := time.Now()
+
+	shadows.mu.Lock()
+	shadows.m[sn+"/"+childDeviceNo] = &shadow{
+		Properties: map[string]*shadowValue{
+			"Switch": {Value: uint8(1), Time: now.Add(-5 * time.Second).UnixMilli()},
+			"Ua":     {Value: "222.8", Time: now.Add(-time.Minute).UnixMilli()},
+		},
+		LastSeen: now.UnixMilli(),
+	}
+	shadows.mu.Unlock()
+
+	defer func() {
+		shadows.mu.Lock()
+		delete(shadows.m, sn+"/"+childDeviceNo)
+		shadows.mu.Unlock()
+	}()
+
+	values := cached(sn, childDeviceNo, []string{"Switch", "Ua", "Ia"}, 10*time.Second, now)
+	c.Assert(values, DeepEquals, map[string]any{"Switch": uint8(1)})
+
+	get := &getPropertyRequest{
+		Identifiers:   []string{"Switch", "LeakageProtection", "Ua"},
+		ChildDeviceNo: childDeviceNo,
+		MaxAge:        10000,
+	}
+
+	commands, results, err := get.commands()
+	c.Assert(err, IsNil)
+
+	data := make(map[string]any)
+	commands = get.fromCache(sn, childDeviceNo, commands, data, results)
+
+	// Switch来自缓存，同一帧的LeakageProtection和过期的Ua仍需读取
+	c.Assert(data, DeepEquals, map[string]any{"Switch": uint8(1)})
+	c.Assert(results["Switch"].Cached, Equals, true)
+	c.Assert(commands, HasLen, 2)
+	c.Assert(commands[0].identifiers, DeepEquals, []string{"LeakageProtection"})
+	c.Assert(commands[1].identifiers, DeepEquals, []string{"Ua"})
+}
+
+func (s *ShadowTestSuite) TestUpdate(c *C) {
+	now := time.Now()
+	sh := &shadow{Properties: make(map[string]*shadowValue)}
+
+	c.Assert(sh.update(map[string]any{"Switch": uint8(1), "Ua": decimal.RequireFromString("222.8")}, now, time.Minute), Equals, true)
+
+	// 没有变化时不发布，但读取时间仍然更新
+	now = now.Add(10 * time.Second)
+	c.Assert(sh.update(map[string]any{"Switch": uint8(1), "Ua": decimal.RequireFromString("222.80")}, now, time.Minute), Equals, false)
+	c.Assert(sh.Properties["Switch"].Time, Equals, now.UnixMilli())
+
+	c.Assert(sh.update(map[string]any{"Switch": uint8(0)}, now, time.Minute), Equals, true)
+
+	// 超过完整性周期
+	c.Assert(sh.update(map[string]any{"Switch": uint8(0)}, now.Add(59*time.Second), time.Minute), Equals, false)
+	c.Assert(sh.update(map[string]any{"Switch": uint8(0)}, now.Add(time.Minute), time.Minute), Equals, true)
+
+	// 完整性周期为0时每次都发布
+	c.Assert(sh.update(map[string]any{"Switch": uint8(0)}, now.Add(time.Minute), 0), Equals, true)
+}
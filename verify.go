@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"reflect"
+	"ricn-smart/jg-gw/modbus"
+	"time"
+)
+
+// verifyInterval 遥控后轮询遥信的间隔
+var verifyInterval = time.Second
+
+// verifier 写入成功后确认设备上的值，返回每个标识符是否一致
+// 集中器可能回复了写入成功而命令并未到达开关，因此需要再读一次
+type verifier func(ctx context.Context, gateway *session) (map[string]bool, error)
+
+// verifySettings 读回定值，与写入的值比较
+func verifySettings(id modbus.ID, batch []*modbus.ActionRegister, expected map[string]any) verifier {
+	return func(ctx context.Context, gateway *session) (map[string]bool, error) {
+		resp, err := gateway.do(ctx, modbus.NewMultiReadFrame(id, batch))
+		if err != nil {
+			return nil, err
+		}
+
+		values, err := modbus.ParseMultiReadResp(resp, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		updateShadow(gateway.sn, id.String(), values, time.Now(), time.Duration(gateway.cfg.Report.Integrity))
+
+		verified := make(map[string]bool)
+		for _, r := range batch {
+			verified[r.Name()] = equal(values[r.Name()], expected[r.Name()])
+		}
+		return verified, nil
+	}
+}
+
+// verifyTelemetering 遥控后轮询同名的遥信点，直到状态与命令一致，ctx结束时仍不一致则确认失败
+func verifyTelemetering(id modbus.ID, identifier string, state uint8) verifier {
+	return func(ctx context.Context, gateway *session) (map[string]bool, error) {
+		for {
+			resp, err := gateway.do(ctx, modbus.NewTelemetering(id))
+			if err == nil {
+				values := make(map[string]any)
+				if err = resp.NewTelemeteringAck(values); err == nil {
+					updateShadow(gateway.sn, id.String(), values, time.Now(), time.Duration(gateway.cfg.Report.Integrity))
+
+					if values[identifier] == state {
+						return map[string]bool{identifier: true}, nil
+					}
+				}
+			}
+
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Str("sn", gateway.sn).Str("node", id.String()).Msg("确认遥控结果")
+			}
+
+			select {
+			case <-ctx.Done():
+				return map[string]bool{identifier: false}, nil
+			case <-time.After(verifyInterval):
+			}
+		}
+	}
+}
+
+// equal 数值按大小比较，"70" 与 "70.0" 相等
+func equal(a, b any) bool {
+	da, ok1 := toDecimal(a)
+	db, ok2 := toDecimal(b)
+	if ok1 && ok2 {
+		return da.Equal(db)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// verified 所有标识符是否都已确认
+func verified(results map[string]*result) bool {
+	for _, r := range results {
+		if r.Verified == nil || !*r.Verified {
+			return false
+		}
+	}
+	return true
+}